@@ -0,0 +1,108 @@
+package habrdl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+)
+
+// minArticleText is the length of extracted text below which the page is
+// assumed to be rendered by JavaScript and the article API is tried.
+const minArticleText = 500
+
+// habrArticle is the part of Habr's article API response the fallback uses.
+type habrArticle struct {
+	TitleHTML     string `json:"titleHtml"`
+	TextHTML      string `json:"textHtml"`
+	Lang          string `json:"lang"`
+	TimePublished string `json:"timePublished"`
+	Author        *struct {
+		Alias string `json:"alias"`
+	} `json:"author"`
+	Hubs []struct {
+		Title string `json:"title"`
+	} `json:"hubs"`
+	Tags []struct {
+		TitleHTML string `json:"titleHtml"`
+	} `json:"tags"`
+	LeadData *struct {
+		ImageURL string `json:"imageUrl"`
+	} `json:"leadData"`
+	Metadata *struct {
+		MetaDescription string `json:"metaDescription"`
+	} `json:"metadata"`
+	Polls []struct {
+		TextHTML   string `json:"textHtml"`
+		VotesCount int    `json:"votesCount"`
+		Variants   []struct {
+			TextHTML   string  `json:"textHtml"`
+			VotesCount int     `json:"votesCount"`
+			Percent    float64 `json:"percent"`
+		} `json:"variants"`
+	} `json:"polls"`
+}
+
+// fetchArticleAPI downloads the article at u from Habr's public API,
+// served by the same host as the article, and renders it as a page with
+// the markup the metadata extractors look for.
+func fetchArticleAPI(ctx context.Context, f *Fetcher, u *url.URL) ([]byte, error) {
+	id := articleID(u)
+	if id == "" {
+		return nil, fmt.Errorf("no article ID in %s", u)
+	}
+	apiURL := fmt.Sprintf("%s://%s/kek/v2/articles/%s/?fl=ru&hl=ru", u.Scheme, u.Host, id)
+	data, _, err := f.fetch(ctx, apiURL, "")
+	if err != nil {
+		return nil, err
+	}
+	var a habrArticle
+	if err := json.Unmarshal(data, &a); err != nil {
+		return nil, fmt.Errorf("failed to decode article API response: %w", err)
+	}
+	if a.TextHTML == "" {
+		return nil, fmt.Errorf("article API returned no text")
+	}
+
+	// Titles come as HTML already; everything else is plain text.
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<!DOCTYPE html><html lang="%s"><head><meta charset="utf-8"><title>%s</title>`,
+		html.EscapeString(a.Lang), a.TitleHTML)
+	if a.LeadData != nil && a.LeadData.ImageURL != "" {
+		fmt.Fprintf(&buf, `<meta property="og:image" content="%s">`, html.EscapeString(a.LeadData.ImageURL))
+	}
+	if a.Metadata != nil && a.Metadata.MetaDescription != "" {
+		fmt.Fprintf(&buf, `<meta name="description" content="%s">`, html.EscapeString(a.Metadata.MetaDescription))
+	}
+	fmt.Fprintf(&buf, `</head><body><article><h1>%s</h1><div id="post-content-body">%s</div></article>`, a.TitleHTML, a.TextHTML)
+	// Polls in the markup of the page, for extractPolls.
+	for _, p := range a.Polls {
+		fmt.Fprintf(&buf, `<div class="tm-poll"><div class="tm-poll__header">%s</div>`, p.TextHTML)
+		for _, v := range p.Variants {
+			fmt.Fprintf(&buf, `<div class="tm-poll-result"><span class="tm-poll-result__text">%s</span><span class="tm-poll-result__votes">%d</span>`, v.TextHTML, v.VotesCount)
+			if v.Percent > 0 {
+				fmt.Fprintf(&buf, `<span class="tm-poll-result__percent">%g%%</span>`, v.Percent)
+			}
+			buf.WriteString("</div>")
+		}
+		fmt.Fprintf(&buf, `<div class="tm-poll__votes">%d</div></div>`, p.VotesCount)
+	}
+	// Readability drops <footer>, so the metadata stays out of the text.
+	buf.WriteString("<footer>")
+	if a.Author != nil && a.Author.Alias != "" {
+		fmt.Fprintf(&buf, `<a class="tm-user-info__username">%s</a>`, html.EscapeString(a.Author.Alias))
+	}
+	if a.TimePublished != "" {
+		fmt.Fprintf(&buf, `<time datetime="%s"></time>`, html.EscapeString(a.TimePublished))
+	}
+	for _, hub := range a.Hubs {
+		fmt.Fprintf(&buf, `<a class="tm-publication-hubs__link">%s</a>`, html.EscapeString(hub.Title))
+	}
+	for _, tag := range a.Tags {
+		fmt.Fprintf(&buf, `<a class="tm-tags-list__link">%s</a>`, tag.TitleHTML)
+	}
+	buf.WriteString("</footer></body></html>")
+	return buf.Bytes(), nil
+}
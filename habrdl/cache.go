@@ -0,0 +1,139 @@
+package habrdl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// DefaultCacheDir returns the image cache directory in the user's cache
+// folder, e.g. ~/.cache/habrdownloader/images.
+func DefaultCacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "habrdownloader", "images"), nil
+}
+
+// hashHex returns the hex-encoded SHA-256 of data.
+func hashHex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// cachedBinary returns the cached content of resourceURL and its
+// Content-Type, or ok=false on a miss. The cache keeps every download
+// under the hash of its content, so an image reached through several URLs
+// is stored once, plus an entry per URL, named after the hash of the URL,
+// holding the Content-Type and the content hash.
+func (f *Fetcher) cachedBinary(resourceURL string) (data []byte, contentType string, ok bool) {
+	entry, err := os.ReadFile(filepath.Join(f.CacheDir, hashHex([]byte(resourceURL))+".url"))
+	if err != nil {
+		return nil, "", false
+	}
+	contentType, contentHash, found := strings.Cut(strings.TrimSuffix(string(entry), "\n"), "\n")
+	if !found {
+		return nil, "", false
+	}
+	data, err = os.ReadFile(filepath.Join(f.CacheDir, contentHash))
+	if err != nil || hashHex(data) != contentHash {
+		return nil, "", false
+	}
+	return data, contentType, true
+}
+
+// storeBinary adds a download to the cache. Files are written under a
+// temporary name and renamed, so concurrent downloads never see half an
+// entry.
+func (f *Fetcher) storeBinary(resourceURL string, data []byte, contentType string) error {
+	if err := os.MkdirAll(f.CacheDir, 0o755); err != nil {
+		return err
+	}
+	contentHash := hashHex(data)
+	if err := writeFileAtomic(filepath.Join(f.CacheDir, contentHash), data); err != nil {
+		return err
+	}
+	entry := strings.ReplaceAll(contentType, "\n", " ") + "\n" + contentHash + "\n"
+	return writeFileAtomic(filepath.Join(f.CacheDir, hashHex([]byte(resourceURL))+".url"), []byte(entry))
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// binaryMemo keeps the images or API responses downloaded during one
+// conversion in memory, failures included, so the further formats built
+// from it neither download nor retry anything.
+type binaryMemo struct {
+	mu      sync.Mutex
+	entries map[string]*binaryEntry
+}
+
+// binaryEntry is a download kept by binaryMemo.
+type binaryEntry struct {
+	data []byte
+	ext  string
+	err  error
+}
+
+// fetch returns the remembered download of resourceURL, downloading it
+// with f the first time.
+func (m *binaryMemo) fetch(ctx context.Context, f *Fetcher, resourceURL string) ([]byte, string, error) {
+	return m.remember(resourceURL, func() ([]byte, string, error) {
+		return f.FetchBinary(ctx, resourceURL)
+	})
+}
+
+// fetchText returns the remembered response to resourceURL, an API
+// request rather than an image, fetching it with f the first time.
+func (m *binaryMemo) fetchText(ctx context.Context, f *Fetcher, resourceURL string) ([]byte, error) {
+	data, _, err := m.remember(resourceURL, func() ([]byte, string, error) {
+		data, _, err := f.fetch(ctx, resourceURL, "")
+		return data, "", err
+	})
+	return data, err
+}
+
+// remember returns the entry of resourceURL, calling load to make it the
+// first time.
+func (m *binaryMemo) remember(resourceURL string, load func() ([]byte, string, error)) ([]byte, string, error) {
+	m.mu.Lock()
+	entry, ok := m.entries[resourceURL]
+	m.mu.Unlock()
+	if ok {
+		return entry.data, entry.ext, entry.err
+	}
+	entry = &binaryEntry{}
+	entry.data, entry.ext, entry.err = load()
+	m.mu.Lock()
+	if m.entries == nil {
+		m.entries = make(map[string]*binaryEntry)
+	}
+	m.entries[resourceURL] = entry
+	m.mu.Unlock()
+	return entry.data, entry.ext, entry.err
+}
@@ -0,0 +1,101 @@
+package habrdl
+
+import (
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// maxCaptionText bounds the italic text taken for a caption, so a whole
+// emphasized paragraph after an image is not mistaken for one.
+const maxCaptionText = 300
+
+// wrapCaptions puts images and their captions together into
+// <figure><img/><figcaption>…</figcaption></figure>. Captions are a
+// <figcaption> that lost its figure, or the italic line after a <br> that
+// older Habr articles use. Images already in a figure only lose empty
+// captions, and images without a caption are left alone. It returns the
+// number of wrapped images.
+func wrapCaptions(doc *goquery.Document) int {
+	wrapped := 0
+	doc.Find("img").Each(func(i int, s *goquery.Selection) {
+		if figure := s.Closest("figure"); figure.Length() > 0 {
+			figure.Find("figcaption").Each(func(i int, c *goquery.Selection) {
+				if strings.TrimSpace(c.Text()) == "" {
+					c.Remove()
+				}
+			})
+			return
+		}
+
+		// A linked image is captioned as a whole.
+		target := s
+		if parent := s.Parent(); parent.Is("a") && parent.Children().Length() == 1 && strings.TrimSpace(parent.Text()) == "" {
+			target = parent
+		}
+		markup, err := goquery.OuterHtml(target)
+		if err != nil {
+			return
+		}
+
+		if next := nextContent(target); next != nil && next.Is("figcaption") {
+			if caption, err := next.Html(); err == nil && strings.TrimSpace(next.Text()) != "" {
+				next.Remove()
+				target.ReplaceWithHtml(figureHTML(markup, caption))
+				wrapped++
+			}
+			return
+		}
+
+		// <p><img><br><i>caption</i></p>, with nothing else in the block.
+		block := target.Parent()
+		if !block.Is("p, div") {
+			return
+		}
+		var rest []*goquery.Selection
+		block.Contents().Each(func(i int, n *goquery.Selection) {
+			if goquery.NodeName(n) == "#text" && strings.TrimSpace(n.Text()) == "" {
+				return
+			}
+			if n.Get(0) != target.Get(0) && !n.Is("br") {
+				rest = append(rest, n)
+			}
+		})
+		if len(rest) != 1 || !rest[0].Is("i, em") {
+			return
+		}
+		text := strings.TrimSpace(rest[0].Text())
+		if text == "" || len([]rune(text)) > maxCaptionText {
+			return
+		}
+		if caption, err := rest[0].Html(); err == nil {
+			block.ReplaceWithHtml(figureHTML(markup, caption))
+			wrapped++
+		}
+	})
+	return wrapped
+}
+
+// nextContent returns the sibling node following s, skipping whitespace,
+// or nil when s is the last one.
+func nextContent(s *goquery.Selection) *goquery.Selection {
+	var next *goquery.Selection
+	found := false
+	s.Parent().Contents().EachWithBreak(func(i int, n *goquery.Selection) bool {
+		if !found {
+			found = n.Get(0) == s.Get(0)
+			return true
+		}
+		if goquery.NodeName(n) == "#text" && strings.TrimSpace(n.Text()) == "" {
+			return true
+		}
+		next = n
+		return false
+	})
+	return next
+}
+
+// figureHTML wraps image markup and caption HTML into a figure.
+func figureHTML(image, caption string) string {
+	return "<figure>" + image + "<figcaption>" + strings.TrimSpace(caption) + "</figcaption></figure>"
+}
@@ -0,0 +1,139 @@
+package habrdl
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// habrComment is one entry of Habr's comments API response.
+type habrComment struct {
+	ID            string   `json:"id"`
+	TimePublished string   `json:"timePublished"`
+	Message       string   `json:"message"`
+	Children      []string `json:"children"`
+	Score         int      `json:"score"`
+	Author        *struct {
+		Alias string `json:"alias"`
+	} `json:"author"`
+}
+
+// habrComments is the response of /kek/v2/articles/<id>/comments/.
+type habrComments struct {
+	Comments map[string]*habrComment `json:"comments"`
+	Threads  []string                `json:"threads"`
+}
+
+// fetchComments downloads the comment tree of the article at u from
+// Habr's public API, served by the same host as the article.
+func fetchComments(ctx context.Context, opts *Options, u *url.URL) (*habrComments, error) {
+	id := articleID(u)
+	if id == "" {
+		return nil, fmt.Errorf("no article ID in %s", u)
+	}
+	apiURL := fmt.Sprintf("%s://%s/kek/v2/articles/%s/comments/?fl=ru&hl=ru", u.Scheme, u.Host, id)
+	// Not FetchURL: a 404 here means no comments API, not a deleted article.
+	data, err := opts.fetchText(ctx, apiURL)
+	if err != nil {
+		return nil, err
+	}
+	var c habrComments
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("unexpected comments response: %w", err)
+	}
+	return &c, nil
+}
+
+// filterComments drops the comments rated below minRating. A comment
+// with a reply that is kept stays as well, so the reply keeps its
+// context. It returns the number of comments left.
+func filterComments(c *habrComments, minRating int) int {
+	kept := make(map[string]bool)
+	var visit func(id string) bool
+	visit = func(id string) bool {
+		cm, ok := c.Comments[id]
+		if !ok {
+			return false
+		}
+		keep := cm.Score >= minRating
+		var children []string
+		for _, child := range cm.Children {
+			if visit(child) {
+				children = append(children, child)
+				keep = true
+			}
+		}
+		cm.Children = children
+		kept[id] = keep
+		return keep
+	}
+	var threads []string
+	for _, id := range c.Threads {
+		if visit(id) {
+			threads = append(threads, id)
+		}
+	}
+	c.Threads = threads
+	for id := range c.Comments {
+		if !kept[id] {
+			delete(c.Comments, id)
+		}
+	}
+	return len(c.Comments)
+}
+
+// commentsHTML renders the comment threads as nested blocks, one level of
+// nesting per reply depth.
+func commentsHTML(c *habrComments) string {
+	var buf bytes.Buffer
+	buf.WriteString("<h2>Comments</h2>")
+	var render func(id string)
+	render = func(id string) {
+		cm, ok := c.Comments[id]
+		if !ok {
+			return
+		}
+		author := "deleted"
+		if cm.Author != nil && cm.Author.Alias != "" {
+			author = cm.Author.Alias
+		}
+		buf.WriteString(`<div class="comment"><p class="comment-meta"><b>`)
+		buf.WriteString(html.EscapeString(author))
+		buf.WriteString("</b>")
+		if t, err := time.Parse(time.RFC3339, cm.TimePublished); err == nil {
+			buf.WriteString(" · " + t.UTC().Format("2006-01-02 15:04"))
+		}
+		fmt.Fprintf(&buf, " · %+d", cm.Score)
+		buf.WriteString("</p>")
+		buf.WriteString(commentBody(cm.Message))
+		for _, child := range cm.Children {
+			render(child)
+		}
+		buf.WriteString("</div>")
+	}
+	for _, id := range c.Threads {
+		render(id)
+	}
+	return buf.String()
+}
+
+// commentBody re-serializes a comment's HTML so it is well-formed inside
+// the EPUB's XHTML; plain text is escaped.
+func commentBody(message string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(message))
+	if err != nil {
+		return "<p>" + html.EscapeString(message) + "</p>"
+	}
+	body, err := doc.Find("body").Html()
+	if err != nil {
+		return "<p>" + html.EscapeString(message) + "</p>"
+	}
+	return `<div class="comment-body">` + body + "</div>"
+}
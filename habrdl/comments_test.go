@@ -0,0 +1,58 @@
+package habrdl
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// The comments are fetched once per conversion, not once per format.
+func TestCommentsFetchedOnce(t *testing.T) {
+	page, err := os.ReadFile("testdata/table_article.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var requests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ru/articles/100/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	})
+	mux.HandleFunc("/kek/v2/articles/100/comments/", func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"comments":{"1":{"id":"1","message":"<p>Спасибо за таблицу</p>","score":3,"author":{"alias":"reader"}}},"threads":["1"]}`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	opts := Options{
+		Fetcher:      NewFetcher(nil),
+		AllowAnyHost: true,
+		Comments:     true,
+		Logf:         t.Logf,
+	}
+	opts.Fetcher.Retries = 0
+	books, err := ConvertFormats(context.Background(), srv.URL+"/ru/articles/100/", []string{"html", "md", "txt"}, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, book := range books {
+		defer book.Close()
+	}
+	if n := requests.Load(); n != 1 {
+		t.Errorf("comments fetched %d times for 3 formats, want 1", n)
+	}
+	var buf bytes.Buffer
+	if _, err := books[0].WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "Спасибо за таблицу") {
+		t.Error("html book lacks the comment")
+	}
+}
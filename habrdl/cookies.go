@@ -0,0 +1,70 @@
+package habrdl
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isHabrHost reports whether host belongs to Habr, so that the session
+// cookie is never sent to image CDNs or other third-party hosts.
+func isHabrHost(host string) bool {
+	host = strings.ToLower(strings.TrimPrefix(host, "."))
+	return habrHosts[host] || strings.HasSuffix(host, ".habr.com")
+}
+
+// cookieFor returns the Cookie header to send with a request to
+// resourceURL, or an empty string for hosts outside Habr.
+func (f *Fetcher) cookieFor(resourceURL string) string {
+	if f.Cookie == "" {
+		return ""
+	}
+	u, err := url.Parse(resourceURL)
+	if err != nil || !isHabrHost(u.Hostname()) {
+		return ""
+	}
+	return f.Cookie
+}
+
+// ReadCookieFile reads a cookies.txt file in the Netscape format exported
+// by browsers and curl, and returns the Habr cookies it holds as a value
+// for the Cookie header. Expired cookies and other domains are skipped.
+func ReadCookieFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var pairs []string
+	now := time.Now().Unix()
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		// curl marks HttpOnly cookies with a prefix on an otherwise normal line.
+		line = strings.TrimPrefix(line, "#HttpOnly_")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return "", fmt.Errorf("%s:%d: expected 7 tab-separated fields, got %d", path, lineNo, len(fields))
+		}
+		domain, expires, name, value := fields[0], fields[4], fields[5], fields[6]
+		if !isHabrHost(domain) {
+			continue
+		}
+		if exp, err := strconv.ParseInt(expires, 10, 64); err == nil && exp != 0 && exp < now {
+			continue
+		}
+		pairs = append(pairs, name+"="+value)
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return strings.Join(pairs, "; "), nil
+}
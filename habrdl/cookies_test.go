@@ -0,0 +1,74 @@
+package habrdl
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCookieFor(t *testing.T) {
+	f := &Fetcher{Cookie: "habrsession_id=secret"}
+	tests := []struct {
+		url  string
+		sent bool
+	}{
+		{"https://habr.com/ru/articles/123456/", true},
+		{"https://HABR.COM/ru/articles/123456/", true},
+		{"https://www.habr.com/ru/articles/123456/", true},
+		{"https://m.habr.com/ru/post/123456/", true},
+		{"https://habr.ru/post/123456/", true},
+		{"https://api.habr.com/kek/v2/articles/123456", true},
+		{"https://habr.com:443/ru/articles/123456/", true},
+		{"https://evilhabr.com/ru/articles/123456/", false},
+		{"https://habr.com.evil.example/ru/articles/123456/", false},
+		{"https://habr.community/", false},
+		{"https://habrastorage.org/getpro/habr/upload_files/a.png", false},
+		{"https://hsto.org/webt/ab/cd/ef.png", false},
+		{"https://img.youtube.com/vi/x/hqdefault.jpg", false},
+		{"not a url %zz", false},
+	}
+	for _, tt := range tests {
+		got := f.cookieFor(tt.url)
+		if tt.sent && got != f.Cookie {
+			t.Errorf("cookieFor(%q) = %q, want the session cookie", tt.url, got)
+		}
+		if !tt.sent && got != "" {
+			t.Errorf("cookieFor(%q) = %q, want no cookie", tt.url, got)
+		}
+	}
+
+	if got := (&Fetcher{}).cookieFor("https://habr.com/"); got != "" {
+		t.Errorf("cookieFor without a cookie = %q, want empty", got)
+	}
+}
+
+func TestReadCookieFile(t *testing.T) {
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	past := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	content := "# Netscape HTTP Cookie File\n" +
+		".habr.com\tTRUE\t/\tTRUE\t" + future + "\thabrsession_id\tabc\n" +
+		"#HttpOnly_habr.com\tFALSE\t/\tTRUE\t0\tconnect_sid\tdef\n" +
+		".habr.com\tTRUE\t/\tTRUE\t" + past + "\told\texpired\n" +
+		".evilhabr.com\tTRUE\t/\tTRUE\t0\tstolen\tghi\n" +
+		"habrastorage.org\tFALSE\t/\tTRUE\t0\tcdn\tjkl\n"
+	path := filepath.Join(t.TempDir(), "cookies.txt")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadCookieFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "habrsession_id=abc; connect_sid=def"; got != want {
+		t.Errorf("ReadCookieFile = %q, want %q", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte("habr.com\tTRUE\t/\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadCookieFile(path); err == nil {
+		t.Error("ReadCookieFile accepted a line with missing fields")
+	}
+}
@@ -0,0 +1,154 @@
+package habrdl
+
+import (
+	"bytes"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strings"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// The generated cover is a 2:3 portrait, the shape reader libraries
+// expect.
+const (
+	coverWidth  = 1200
+	coverHeight = 1800
+	coverMargin = 110
+)
+
+// coverPalette holds the background colors of generated covers; the
+// title picks one, so a book keeps its color across downloads.
+var coverPalette = []color.RGBA{
+	{0x2e, 0x4a, 0x62, 0xff},
+	{0x3b, 0x5b, 0x4a, 0xff},
+	{0x5a, 0x3d, 0x5c, 0xff},
+	{0x6b, 0x45, 0x3a, 0xff},
+	{0x35, 0x3f, 0x54, 0xff},
+	{0x4d, 0x55, 0x3a, 0xff},
+}
+
+// coverText is what a generated cover shows.
+type coverText struct {
+	title     string
+	author    string
+	published string
+}
+
+// drawCover renders a PNG cover with the title in large type at the top
+// and the author and publication date at the bottom.
+func drawCover(text coverText) ([]byte, error) {
+	bold, err := opentype.Parse(gobold.TTF)
+	if err != nil {
+		return nil, err
+	}
+	regular, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return nil, err
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(text.title))
+	background := coverPalette[h.Sum32()%uint32(len(coverPalette))]
+	img := image.NewRGBA(image.Rect(0, 0, coverWidth, coverHeight))
+	draw.Draw(img, img.Bounds(), image.NewUniform(background), image.Point{}, draw.Src)
+	light := color.RGBA{0xf4, 0xf1, 0xea, 0xff}
+	draw.Draw(img, image.Rect(coverMargin, 220, coverWidth-coverMargin, 232), image.NewUniform(light), image.Point{}, draw.Src)
+
+	// Long titles get smaller type rather than running off the cover.
+	width := coverWidth - 2*coverMargin
+	var face font.Face
+	var lines []string
+	var size float64
+	for size = 104; ; size -= 8 {
+		if face, err = opentype.NewFace(bold, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull}); err != nil {
+			return nil, err
+		}
+		lines = wrapText(face, strings.TrimSpace(text.title), width)
+		if len(lines) <= 8 || size <= 48 {
+			break
+		}
+		face.Close()
+	}
+	y := 232 + int(size*1.6)
+	for _, line := range lines {
+		drawLine(img, face, light, line, y)
+		y += int(size * 1.25)
+	}
+	face.Close()
+
+	// The date alone; the time of day means nothing on a cover.
+	published := text.published
+	if t, err := time.Parse(time.RFC3339, published); err == nil {
+		published = t.Format("2006-01-02")
+	}
+	y = coverHeight - 240
+	for _, line := range []struct {
+		text string
+		size float64
+	}{{text.author, 56}, {published, 44}} {
+		if line.text == "" {
+			continue
+		}
+		face, err := opentype.NewFace(regular, &opentype.FaceOptions{Size: line.size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return nil, err
+		}
+		drawLine(img, face, light, wrapText(face, line.text, width)[0], y)
+		face.Close()
+		y += int(line.size * 1.6)
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// drawLine draws one line of text with its baseline at y.
+func drawLine(img draw.Image, face font.Face, c color.Color, text string, y int) {
+	d := &font.Drawer{Dst: img, Src: image.NewUniform(c), Face: face, Dot: fixed.P(coverMargin, y)}
+	d.DrawString(text)
+}
+
+// wrapText breaks text into lines no wider than width pixels, at spaces
+// where possible and inside words that do not fit on a line of their own.
+func wrapText(face font.Face, text string, width int) []string {
+	limit := fixed.I(width)
+	var lines []string
+	var line string
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if font.MeasureString(face, candidate) <= limit {
+			line = candidate
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		line = ""
+		for _, r := range word {
+			if line != "" && font.MeasureString(face, line+string(r)) > limit {
+				lines = append(lines, line)
+				line = ""
+			}
+			line += string(r)
+		}
+	}
+	if line != "" || len(lines) == 0 {
+		lines = append(lines, line)
+	}
+	return lines
+}
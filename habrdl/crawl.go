@@ -0,0 +1,264 @@
+package habrdl
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// maxListingPages bounds how many pages of an article listing are read.
+const maxListingPages = 200
+
+// ListedArticle is an article found on a listing page such as an author's
+// article list.
+type ListedArticle struct {
+	// URL is the absolute article URL.
+	URL string
+	// Title is the article title shown in the listing.
+	Title string
+	// Published is the publication time shown in the listing, if any.
+	Published time.Time
+	// Rating is the article score shown in the listing, 0 when missing.
+	Rating int
+	// ID is the numeric Habr article ID taken from URL, 0 when missing.
+	ID int
+}
+
+// UserArticlesURL returns the article listing of the Habr user name. A
+// full URL is returned unchanged, so mirrors can be crawled too.
+func UserArticlesURL(name string) string {
+	if strings.Contains(name, "://") {
+		return name
+	}
+	return "https://habr.com/ru/users/" + url.PathEscape(strings.TrimPrefix(name, "@")) + "/articles/"
+}
+
+// BookmarksURL returns the bookmarked articles of the Habr user name, or
+// name itself when it is a full URL. Private bookmarks are only listed
+// with the user's session cookie (see Fetcher.Cookie).
+func BookmarksURL(name string) string {
+	if strings.Contains(name, "://") {
+		return name
+	}
+	return "https://habr.com/ru/users/" + url.PathEscape(strings.TrimPrefix(name, "@")) + "/bookmarks/articles/"
+}
+
+// HubArticlesURL returns the article listing of the Habr hub slug, or
+// slug itself when it is a full URL.
+func HubArticlesURL(slug string) string {
+	if strings.Contains(slug, "://") {
+		return slug
+	}
+	return "https://habr.com/ru/hubs/" + url.PathEscape(slug) + "/articles/"
+}
+
+// CompanyArticlesURL returns the blog listing of the Habr company slug,
+// or slug itself when it is a full URL.
+func CompanyArticlesURL(slug string) string {
+	if strings.Contains(slug, "://") {
+		return slug
+	}
+	return "https://habr.com/ru/companies/" + url.PathEscape(slug) + "/articles/"
+}
+
+// ListArticles walks the article listing at listURL page by page, through
+// Habr's /pageN/ pagination, and returns the articles in listing order
+// without duplicates. It stops at the first page that adds no article or
+// does not exist. Listings run from new to old, so when since is not zero
+// the walk also stops after a page whose dated articles are all older, and
+// when sinceID is not zero after a page whose article IDs are all at most
+// sinceID. The articles of that last page are returned unfiltered. Lists
+// ordered otherwise, such as bookmarks, need both bounds zero.
+func ListArticles(ctx context.Context, f *Fetcher, listURL string, since time.Time, sinceID int) ([]ListedArticle, error) {
+	return listArticles(ctx, f, listURL, since, sinceID, maxListingPages)
+}
+
+// listArticles is ListArticles reading at most maxPages pages.
+func listArticles(ctx context.Context, f *Fetcher, listURL string, since time.Time, sinceID, maxPages int) ([]ListedArticle, error) {
+	base, err := url.Parse(listURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listing URL: %w", err)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+
+	var articles []ListedArticle
+	seen := make(map[string]bool)
+	for page := 1; page <= maxPages; page++ {
+		pageURL := *base
+		if page > 1 {
+			pageURL.Path += fmt.Sprintf("page%d/", page)
+		}
+		data, _, err := f.fetch(ctx, pageURL.String(), "")
+		var statusErr *httpStatusError
+		if page > 1 && errors.As(err, &statusErr) && statusErr.StatusCode == 404 {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch listing page %d: %w", page, err)
+		}
+		doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse listing page %d: %w", page, err)
+		}
+
+		added, dated, older, numbered, oldIDs := 0, 0, 0, 0, 0
+		for _, a := range listedArticles(doc, &pageURL) {
+			u, _ := url.Parse(a.URL)
+			if key := seriesKey(u); !seen[key] {
+				seen[key] = true
+				articles = append(articles, a)
+				added++
+			}
+			if !a.Published.IsZero() {
+				dated++
+				if a.Published.Before(since) {
+					older++
+				}
+			}
+			if a.ID != 0 {
+				numbered++
+				if a.ID <= sinceID {
+					oldIDs++
+				}
+			}
+		}
+		// Pinned posts may be old, hence all of the page rather than the first.
+		if added == 0 || (!since.IsZero() && dated > 0 && older == dated) ||
+			(sinceID != 0 && numbered > 0 && oldIDs == numbered) {
+			break
+		}
+	}
+	return articles, nil
+}
+
+// listedArticles returns the articles of one listing page: for every
+// <article> snippet, the first link to an article path, titled by the
+// snippet heading.
+func listedArticles(doc *goquery.Document, pageURL *url.URL) []ListedArticle {
+	var articles []ListedArticle
+	doc.Find("article").Each(func(i int, snippet *goquery.Selection) {
+		snippet.Find("a[href]").EachWithBreak(func(j int, link *goquery.Selection) bool {
+			u, err := pageURL.Parse(link.AttrOr("href", ""))
+			if err != nil || !articlePathPattern.MatchString(u.Path) {
+				return true
+			}
+			u.RawQuery, u.Fragment = "", ""
+			title := strings.TrimSpace(snippet.Find("h2, .tm-title").First().Text())
+			if title == "" {
+				title = strings.TrimSpace(link.Text())
+			}
+			a := ListedArticle{URL: u.String(), Title: title, ID: listedID(u)}
+			if t, err := time.Parse(time.RFC3339, strings.TrimSpace(snippet.Find("time[datetime]").First().AttrOr("datetime", ""))); err == nil {
+				a.Published = t
+			}
+			a.Rating = parseRating(snippet.Find(".tm-votes-meter__value, .tm-votes-lever__score-counter").First().Text())
+			articles = append(articles, a)
+			return false
+		})
+	})
+	return articles
+}
+
+// listedID returns the numeric article ID of u, or 0. IDs are compared as
+// numbers, since "99999" sorts after "100000" as a string.
+func listedID(u *url.URL) int {
+	id, _ := strconv.Atoi(articleID(u))
+	return id
+}
+
+// parseRating reads a listing score such as "+42" or "–3", where Habr may
+// use a typographic minus; it returns 0 for anything else.
+func parseRating(text string) int {
+	text = strings.NewReplacer("−", "-", "–", "-", "+", "", " ", "").Replace(strings.TrimSpace(text))
+	n, err := strconv.Atoi(text)
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// feed holds the parts of an RSS 2.0 or Atom feed that point at articles.
+type feed struct {
+	Items []struct {
+		Title   string `xml:"title"`
+		Link    string `xml:"link"`
+		PubDate string `xml:"pubDate"`
+	} `xml:"channel>item"`
+	Entries []struct {
+		Title string `xml:"title"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Published string `xml:"published"`
+		Updated   string `xml:"updated"`
+	} `xml:"entry"`
+}
+
+// ListFeed returns the articles linked from the RSS or Atom feed at
+// feedURL, in feed order and without duplicates. Links that are not
+// article paths, such as hub pages, are skipped.
+func ListFeed(ctx context.Context, f *Fetcher, feedURL string) ([]ListedArticle, error) {
+	base, err := url.Parse(feedURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid feed URL: %w", err)
+	}
+	data, _, err := f.fetch(ctx, feedURL, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch feed: %w", err)
+	}
+	var fd feed
+	if err := xml.Unmarshal(data, &fd); err != nil {
+		return nil, fmt.Errorf("failed to parse feed: %w", err)
+	}
+
+	var articles []ListedArticle
+	seen := make(map[string]bool)
+	add := func(link, title, date string) {
+		u, err := base.Parse(strings.TrimSpace(link))
+		if err != nil || !articlePathPattern.MatchString(u.Path) {
+			return
+		}
+		// Feed links carry tracking parameters.
+		u.RawQuery, u.Fragment = "", ""
+		key := seriesKey(u)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		a := ListedArticle{URL: u.String(), Title: strings.TrimSpace(title), ID: listedID(u)}
+		for _, layout := range []string{time.RFC1123Z, time.RFC1123, time.RFC3339} {
+			if t, err := time.Parse(layout, strings.TrimSpace(date)); err == nil {
+				a.Published = t
+				break
+			}
+		}
+		articles = append(articles, a)
+	}
+	for _, item := range fd.Items {
+		add(item.Link, item.Title, item.PubDate)
+	}
+	for _, entry := range fd.Entries {
+		date := entry.Published
+		if date == "" {
+			date = entry.Updated
+		}
+		for _, link := range entry.Links {
+			if link.Rel == "" || link.Rel == "alternate" {
+				add(link.Href, entry.Title, date)
+				break
+			}
+		}
+	}
+	return articles, nil
+}
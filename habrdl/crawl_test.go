@@ -0,0 +1,78 @@
+package habrdl
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// listingServer serves a user listing whose pages hold the article IDs of
+// pages, newest first, and records which pages were requested.
+func listingServer(t *testing.T, pages [][]int) (string, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.URL.Path)
+		mu.Unlock()
+		n := 1
+		fmt.Sscanf(strings.TrimPrefix(r.URL.Path, "/ru/users/tester/articles/"), "page%d/", &n)
+		if n < 1 || n > len(pages) {
+			http.NotFound(w, r)
+			return
+		}
+		var body strings.Builder
+		for _, id := range pages[n-1] {
+			fmt.Fprintf(&body, `<article><h2><a href="/ru/articles/%d/">Article %d</a></h2></article>`, id, id)
+		}
+		fmt.Fprintf(w, "<html><body>%s</body></html>", body.String())
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/ru/users/tester/articles/", func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), requested...)
+	}
+}
+
+func TestListArticlesSinceID(t *testing.T) {
+	pages := [][]int{{100002, 100001}, {100000, 99999}, {99998, 99997}}
+	tests := []struct {
+		name    string
+		sinceID int
+		ids     []int
+		pages   int
+	}{
+		{"no bound", 0, []int{100002, 100001, 100000, 99999, 99998, 99997}, 4},
+		// 99999 is below 100000 as a number but not as a string.
+		{"stops at older IDs", 100000, []int{100002, 100001, 100000, 99999}, 2},
+		{"first page already seen", 100002, []int{100002, 100001}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listURL, requested := listingServer(t, pages)
+			f := NewFetcher(nil)
+			f.Retries = 0
+			articles, err := ListArticles(context.Background(), f, listURL, time.Time{}, tt.sinceID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []int
+			for _, a := range articles {
+				ids = append(ids, a.ID)
+			}
+			if fmt.Sprint(ids) != fmt.Sprint(tt.ids) {
+				t.Errorf("IDs = %v, want %v", ids, tt.ids)
+			}
+			if got := requested(); len(got) != tt.pages {
+				t.Errorf("requested %v, want %d pages", got, tt.pages)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package habrdl
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+)
+
+// cssCommentPattern matches CSS comments, which pruneCSS drops.
+var cssCommentPattern = regexp.MustCompile(`(?s)/\*.*?\*/`)
+
+// pseudoElementPattern matches pseudo-elements, which select no element of
+// their own and which the selector engine does not support.
+var pseudoElementPattern = regexp.MustCompile(`::?(before|after|first-line|first-letter|marker|selection|placeholder)\b`)
+
+// pruneCSS drops the rules of css whose selectors name classes or IDs no
+// element of markup, the content of the whole book, carries. Selectors of
+// element types only are kept, since the sections add headings and
+// wrappers of their own, and so are at-rules other than @media and
+// @supports, whose rules are pruned in turn. Selectors the engine cannot
+// parse are kept as well.
+func pruneCSS(css, markup string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(markup))
+	if err != nil {
+		return css
+	}
+	return pruneRules(cssCommentPattern.ReplaceAllString(css, ""), doc)
+}
+
+// pruneRules prunes a list of rules, as found at the top level of a
+// stylesheet or inside a conditional group rule.
+func pruneRules(css string, doc *goquery.Document) string {
+	var out strings.Builder
+	for rest := css; strings.TrimSpace(rest) != ""; {
+		open := strings.IndexAny(rest, "{;")
+		if open < 0 {
+			// A trailing fragment without a block is kept as written.
+			out.WriteString(rest)
+			break
+		}
+		prelude := strings.TrimSpace(rest[:open])
+		if rest[open] == ';' {
+			// Statements such as @import and @charset.
+			out.WriteString(prelude + ";\n")
+			rest = rest[open+1:]
+			continue
+		}
+		end := matchingBrace(rest, open)
+		block := rest[open+1 : end]
+		rest = rest[min(end+1, len(rest)):]
+
+		switch {
+		case strings.HasPrefix(prelude, "@media"), strings.HasPrefix(prelude, "@supports"):
+			if inner := pruneRules(block, doc); strings.TrimSpace(inner) != "" {
+				out.WriteString(prelude + " {\n" + inner + "}\n")
+			}
+		case strings.HasPrefix(prelude, "@"):
+			out.WriteString(prelude + " {" + block + "}\n")
+		default:
+			all := splitSelectors(prelude)
+			if selectors := usedSelectors(all, doc); len(selectors) == len(all) {
+				out.WriteString(prelude + " {" + block + "}\n")
+			} else if len(selectors) > 0 {
+				out.WriteString(strings.Join(selectors, ",\n") + " {" + block + "}\n")
+			}
+		}
+	}
+	return out.String()
+}
+
+// matchingBrace returns the index of the brace closing the one at open, or
+// len(s) when it is missing.
+func matchingBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth--; depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(s)
+}
+
+// usedSelectors returns the selectors that may match an element of doc.
+func usedSelectors(selectors []string, doc *goquery.Document) []string {
+	var used []string
+	for _, sel := range selectors {
+		if selectorUsed(sel, doc) {
+			used = append(used, sel)
+		}
+	}
+	return used
+}
+
+// splitSelectors splits a selector list at the commas outside parentheses,
+// such as those of :not(a, b).
+func splitSelectors(list string) []string {
+	var selectors []string
+	depth, start := 0, 0
+	for i, r := range list {
+		switch r {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				selectors = append(selectors, strings.TrimSpace(list[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	selectors = append(selectors, strings.TrimSpace(list[start:]))
+	return selectors
+}
+
+// selectorUsed reports whether sel may match an element of doc.
+func selectorUsed(sel string, doc *goquery.Document) bool {
+	if sel == "" {
+		return false
+	}
+	if !strings.ContainsAny(sel, ".#") {
+		return true
+	}
+	m, err := cascadia.Compile(pseudoElementPattern.ReplaceAllString(sel, ""))
+	if err != nil {
+		return true
+	}
+	return doc.FindMatcher(m).Length() > 0
+}
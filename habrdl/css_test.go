@@ -0,0 +1,127 @@
+package habrdl
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPruneCSS(t *testing.T) {
+	markup := `<div class="spoiler"><p class="spoiler-title">T</p><pre><code class="language-go">x</code></pre></div><p id="intro">text</p>`
+	css := `/* bundled */
+pre { background: #eee; }
+.spoiler { border: 1px solid; }
+.poll { margin: 1em; }
+.spoiler-title, .spoiler summary, .poll-total { font-weight: bold; }
+#intro { color: red; }
+#outro { color: blue; }
+:not(pre) > code { padding: 0; }
+.spoiler::before { content: "!"; }
+.poll::after { content: "?"; }
+div:has(> .poll) { margin: 0; }
+@font-face { font-family: "Body"; src: url(a.ttf); }
+@import url("extra.css");
+@media print {
+  .spoiler { display: block; }
+  .poll { display: none; }
+}
+@media screen {
+  .poll-total { color: gray; }
+}
+`
+	got := pruneCSS(css, markup)
+
+	for _, kept := range []string{
+		"pre { background: #eee; }",
+		".spoiler { border: 1px solid; }",
+		".spoiler-title { font-weight: bold; }",
+		"#intro { color: red; }",
+		":not(pre) > code { padding: 0; }",
+		`.spoiler::before { content: "!"; }`,
+		`@font-face { font-family: "Body"; src: url(a.ttf); }`,
+		`@import url("extra.css");`,
+		"@media print {\n.spoiler { display: block; }\n}",
+	} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("pruned stylesheet lacks %q:\n%s", kept, got)
+		}
+	}
+	for _, dropped := range []string{".poll {", ".poll-total", "#outro", ".poll::after", "@media screen", "bundled"} {
+		if strings.Contains(got, dropped) {
+			t.Errorf("pruned stylesheet keeps %q:\n%s", dropped, got)
+		}
+	}
+}
+
+func TestPruneCSSKeepsUnparsableSelectors(t *testing.T) {
+	css := ".unknown:frobnicate(1) { color: red; }\n"
+	if got := pruneCSS(css, "<p>text</p>"); !strings.Contains(got, ".unknown:frobnicate(1)") {
+		t.Errorf("pruneCSS dropped a selector it cannot parse: %q", got)
+	}
+}
+
+func TestPruneCSSBundledStylesheet(t *testing.T) {
+	got := pruneCSS(defaultCSS, `<p>Plain text with <code>code</code>.</p>`)
+	if strings.Contains(got, ".spoiler") || strings.Contains(got, ".poll") || strings.Contains(got, ".front-page") {
+		t.Errorf("rules of absent features survived:\n%s", got)
+	}
+	for _, kept := range []string{"pre {", "blockquote {", "table {", ":not(pre) > code {"} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("element rule %q was dropped", kept)
+		}
+	}
+}
+
+// Rules for the markup the Kobo and EPUB 3 wrappers add survive pruning.
+func TestPruneCSSKeepsWrapperRules(t *testing.T) {
+	articleURL := serveArticle(t, "100", "testdata/table_article.html")
+	cssFile := filepath.Join(t.TempDir(), "style.css")
+	css := ".koboSpan { color: inherit; }\n.never-used { color: red; }\n"
+	if err := os.WriteFile(cssFile, []byte(css), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Fetcher: NewFetcher(nil), AllowAnyHost: true, Kepub: true, EPUB3: true, PruneCSS: true, CSSFile: cssFile, Logf: t.Logf}
+	opts.Fetcher.Retries = 0
+	book, err := Convert(context.Background(), articleURL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer book.Close()
+
+	var buf bytes.Buffer
+	if _, err := book.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if path.Base(f.Name) != "style.css" {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), ".koboSpan") {
+			t.Errorf("the .koboSpan rule was pruned:\n%s", data)
+		}
+		if strings.Contains(string(data), ".never-used") {
+			t.Errorf("the unused rule was kept:\n%s", data)
+		}
+		return
+	}
+	t.Fatal("the EPUB has no style.css")
+}
@@ -0,0 +1,205 @@
+package habrdl
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// youtubeEmbedPattern captures the video ID of YouTube embed URLs,
+// including the privacy-enhanced youtube-nocookie.com domain.
+var youtubeEmbedPattern = regexp.MustCompile(`^/embed/([A-Za-z0-9_-]{6,})`)
+
+// codepenEmbedPattern captures the user and pen ID of CodePen embed URLs.
+var codepenEmbedPattern = regexp.MustCompile(`^/([^/]+)/embed/(?:preview/)?([^/?]+)`)
+
+// gistPattern captures the user and ID of gist pages and of their script
+// and iframe embeds.
+var gistPattern = regexp.MustCompile(`^/([^/]+)/([0-9a-f]+)(?:\.js|\.pibb)?/?$`)
+
+// codepenPattern captures the user and pen ID of a CodePen page.
+var codepenPattern = regexp.MustCompile(`^/([^/]+)/pen/([^/?]+)$`)
+
+// maxEmbedCode bounds the size of the source inlined for one embed.
+const maxEmbedCode = 256 << 10
+
+// embedLink describes where an iframe embed can be viewed outside the book.
+type embedLink struct {
+	label     string
+	href      string
+	thumbnail string
+}
+
+// describeEmbed maps an iframe URL to a viewable page, using the provider's
+// regular page (and a thumbnail, where one is known) for YouTube and CodePen.
+func describeEmbed(u *url.URL) embedLink {
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	switch host {
+	case "youtube.com", "youtube-nocookie.com":
+		if m := youtubeEmbedPattern.FindStringSubmatch(u.Path); m != nil {
+			return embedLink{
+				label:     "YouTube video",
+				href:      "https://www.youtube.com/watch?v=" + m[1],
+				thumbnail: "https://img.youtube.com/vi/" + m[1] + "/hqdefault.jpg",
+			}
+		}
+	case "codepen.io":
+		if m := codepenEmbedPattern.FindStringSubmatch(u.Path); m != nil {
+			return embedLink{label: "CodePen demo", href: "https://codepen.io/" + m[1] + "/pen/" + m[2]}
+		}
+	case "gist.github.com":
+		if m := gistPattern.FindStringSubmatch(u.Path); m != nil {
+			return embedLink{label: "GitHub gist", href: "https://gist.github.com/" + m[1] + "/" + m[2]}
+		}
+	}
+	return embedLink{label: "Embedded content from " + host, href: u.String()}
+}
+
+// replaceIframes swaps every <iframe> of page, and every gist embedded
+// with a <script>, for a placeholder figure linking to the embedded
+// content, since e-readers cannot show live embeds. It runs on the raw
+// page so the placeholders reach readability, which drops most iframes and
+// all scripts. It returns the number of replaced embeds.
+func replaceIframes(page *goquery.Document, base *url.URL) int {
+	replaced := 0
+	page.Find(`iframe, script[src*="gist.github.com/"]`).Each(func(i int, s *goquery.Selection) {
+		src := strings.TrimSpace(s.AttrOr("src", ""))
+		if src == "" || src == "about:blank" {
+			src = strings.TrimSpace(s.AttrOr("data-src", ""))
+		}
+		u, err := base.Parse(src)
+		if src == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			s.Remove()
+			return
+		}
+
+		link := describeEmbed(u)
+		title := strings.TrimSpace(s.AttrOr("title", ""))
+		if title == "" {
+			title = link.href
+		}
+		href := html.EscapeString(link.href)
+
+		var b strings.Builder
+		b.WriteString(`<figure class="embed">`)
+		if link.thumbnail != "" {
+			fmt.Fprintf(&b, `<a href="%s"><img src="%s" alt="%s"/></a>`, href, html.EscapeString(link.thumbnail), html.EscapeString(title))
+		}
+		fmt.Fprintf(&b, `<figcaption>%s: <a href="%s">%s</a></figcaption></figure>`,
+			html.EscapeString(link.label), href, html.EscapeString(title))
+		// Readability drops link-only divs, so replace the wrappers Habr puts
+		// around embeds together with the iframe.
+		target := s
+		for parent := target.Parent(); parent.Is("div") && parent.Children().Length() == 1 &&
+			strings.TrimSpace(parent.Text()) == ""; parent = parent.Parent() {
+			target = parent
+		}
+		target.ReplaceWithHtml(b.String())
+		replaced++
+	})
+	return replaced
+}
+
+// inlineEmbedCode adds the source of the gist and CodePen embeds of doc
+// to their placeholder figures, one code block per file, so the book
+// shows the code and not just a link to it. Embeds whose source cannot be
+// fetched keep the link alone, with a warning. It returns the number of
+// embeds that got their code.
+func inlineEmbedCode(ctx context.Context, doc *goquery.Document, opts *Options) int {
+	inlined := 0
+	doc.Find("figure.embed").Each(func(i int, s *goquery.Selection) {
+		u, err := url.Parse(s.Find("figcaption a[href]").Last().AttrOr("href", ""))
+		if err != nil {
+			return
+		}
+		var files []embedFile
+		switch host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www."); {
+		case host == "gist.github.com" && gistPattern.MatchString(u.Path):
+			files, err = gistFiles(ctx, opts, gistPattern.FindStringSubmatch(u.Path)[2])
+		case host == "codepen.io" && codepenPattern.MatchString(u.Path):
+			files, err = codepenFiles(ctx, opts, u)
+		default:
+			return
+		}
+		if err != nil {
+			opts.logf("warning: failed to fetch the code of %s: %v", u, err)
+			return
+		}
+		var b strings.Builder
+		for _, f := range files {
+			if f.name != "" {
+				b.WriteString(`<p class="embed-file">` + html.EscapeString(f.name) + "</p>")
+			}
+			fmt.Fprintf(&b, `<pre><code class="language-%s">%s</code></pre>`, html.EscapeString(f.language), html.EscapeString(f.content))
+		}
+		if b.Len() > 0 {
+			s.Find("figcaption").BeforeHtml(b.String())
+			inlined++
+		}
+	})
+	return inlined
+}
+
+// embedFile is one source file of an embed.
+type embedFile struct {
+	name     string
+	language string
+	content  string
+}
+
+// gistFiles fetches the files of the gist id from the GitHub API.
+func gistFiles(ctx context.Context, opts *Options, id string) ([]embedFile, error) {
+	data, err := opts.fetchText(ctx, "https://api.github.com/gists/"+id)
+	if err != nil {
+		return nil, err
+	}
+	var gist struct {
+		Files map[string]struct {
+			Filename string `json:"filename"`
+			Language string `json:"language"`
+			Content  string `json:"content"`
+		} `json:"files"`
+	}
+	if err := json.Unmarshal(data, &gist); err != nil {
+		return nil, fmt.Errorf("failed to decode gist: %w", err)
+	}
+	var files []embedFile
+	size := 0
+	for _, file := range gist.Files {
+		if size += len(file.Content); size > maxEmbedCode {
+			return nil, errors.New("gist is too large to inline")
+		}
+		files = append(files, embedFile{name: file.Filename, language: strings.ToLower(file.Language), content: file.Content})
+	}
+	// The API returns the files keyed by name, which GitHub shows sorted.
+	sort.Slice(files, func(i, j int) bool { return files[i].name < files[j].name })
+	return files, nil
+}
+
+// codepenFiles fetches the HTML, CSS and JavaScript of the pen at u, which
+// CodePen serves under the pen URL with the language as extension. Empty
+// ones are left out.
+func codepenFiles(ctx context.Context, opts *Options, u *url.URL) ([]embedFile, error) {
+	var files []embedFile
+	for _, lang := range []struct{ ext, name string }{{"html", "HTML"}, {"css", "CSS"}, {"js", "JavaScript"}} {
+		data, err := opts.fetchText(ctx, "https://codepen.io"+u.Path+"."+lang.ext)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxEmbedCode {
+			return nil, errors.New("pen is too large to inline")
+		}
+		if code := strings.TrimSpace(string(data)); code != "" {
+			files = append(files, embedFile{name: lang.name, language: lang.ext, content: code})
+		}
+	}
+	return files, nil
+}
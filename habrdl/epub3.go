@@ -0,0 +1,62 @@
+package habrdl
+
+import (
+	"html"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// navPath is where go-epub stores the EPUB 3 navigation document, and
+// sectionDir the folder of the sections relative to it.
+const (
+	navPath    = "EPUB/nav.xhtml"
+	sectionDir = "xhtml/"
+)
+
+// landmark is an entry of the landmarks navigation of an EPUB 3 book,
+// which readers use to jump to the start of the text or the notes.
+type landmark struct {
+	epubType string
+	file     string
+	title    string
+}
+
+// epub3Section renders the body of an EPUB section as well-formed XHTML
+// inside a <section> of the given epub:type, in place of the HTML document
+// sectionHTML wraps it in. Footnote markers become noterefs and the
+// references list endnotes, so readers can show them as pop-ups, and
+// inline SVG and MathML get the namespaces an XML parser needs. The body
+// is wrapped by sectionHTML if it cannot be parsed.
+func epub3Section(body, epubType string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(sectionHTML(body)))
+	if err != nil {
+		return sectionHTML(body)
+	}
+	doc.Find("sup.footnote-ref a").SetAttr("epub:type", "noteref")
+	doc.Find("ol.references > li").SetAttr("epub:type", "endnote")
+	doc.Find("svg").Each(func(i int, s *goquery.Selection) {
+		if s.ParentsFiltered("svg").Length() == 0 {
+			declareSVGNamespaces(s)
+		}
+	})
+	doc.Find("math").SetAttr("xmlns", "http://www.w3.org/1998/Math/MathML")
+	// The HTML renderer closes void elements, which keeps the output XML.
+	inner, err := doc.Find("body").Html()
+	if err != nil {
+		return sectionHTML(body)
+	}
+	return `<section epub:type="` + epubType + `">` + inner + "</section>"
+}
+
+// landmarksNav renders the landmarks navigation for marks, to be appended
+// to the body of the navigation document.
+func landmarksNav(marks []landmark) string {
+	var buf strings.Builder
+	buf.WriteString(`<nav epub:type="landmarks" hidden=""><h2>Landmarks</h2><ol>`)
+	for _, m := range marks {
+		buf.WriteString(`<li><a epub:type="` + m.epubType + `" href="` + html.EscapeString(sectionDir+m.file) + `">` + html.EscapeString(m.title) + "</a></li>")
+	}
+	buf.WriteString("</ol></nav>")
+	return buf.String()
+}
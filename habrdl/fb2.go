@@ -0,0 +1,518 @@
+package habrdl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// fb2Builder maps the HTML of a rendered book onto FictionBook 2 markup.
+// FB2 knows no CSS and only a fixed set of elements, so blocks become
+// paragraphs, subtitles, citations and tables, and the images, inlined as
+// data: URIs by embedImages, become <binary> elements.
+type fb2Builder struct {
+	buf      strings.Builder
+	inPara   bool
+	inCite   bool
+	marker   string
+	binaries []fb2Binary
+	ids      map[string]string
+}
+
+// fb2Binary is an image stored at the end of an FB2 file.
+type fb2Binary struct {
+	id          string
+	contentType string
+	data        string
+}
+
+// fb2Meta is the description of an FB2 book.
+type fb2Meta struct {
+	title     string
+	author    string
+	lang      string
+	published string
+	summary   string
+	subjects  []string
+	source    string
+	id        string
+	cover     string
+}
+
+// whitespacePattern matches the runs of whitespace collapsed in FB2 text.
+var whitespacePattern = regexp.MustCompile(`\s+`)
+
+// fb2Escape escapes text for XML, dropping the control characters XML
+// does not allow at all.
+func fb2Escape(text string) string {
+	text = strings.Map(func(r rune) rune {
+		if r < 0x20 && r != '\t' && r != '\n' && r != '\r' {
+			return -1
+		}
+		return r
+	}, text)
+	return html.EscapeString(text)
+}
+
+// binary stores the image of a data: URI and returns its id, or an empty
+// string when src is not a base64 data: URI. Repeated images are stored
+// once.
+func (b *fb2Builder) binary(src string) string {
+	if id, ok := b.ids[src]; ok {
+		return id
+	}
+	header, data, ok := strings.Cut(strings.TrimPrefix(src, "data:"), ",")
+	contentType, encoding, _ := strings.Cut(header, ";")
+	if !ok || !strings.HasPrefix(src, "data:") || encoding != "base64" || !strings.HasPrefix(contentType, "image/") {
+		return ""
+	}
+	if b.ids == nil {
+		b.ids = make(map[string]string)
+	}
+	ext := extForContentType(contentType)
+	if ext == "" {
+		ext = ".img"
+	}
+	id := fmt.Sprintf("image_%03d%s", len(b.binaries)+1, ext)
+	b.binaries = append(b.binaries, fb2Binary{id: id, contentType: contentType, data: data})
+	b.ids[src] = id
+	return id
+}
+
+// openPara starts a paragraph unless one is open, beginning it with the
+// pending list marker.
+func (b *fb2Builder) openPara() {
+	if !b.inPara {
+		b.buf.WriteString("<p>" + b.marker)
+		b.marker = ""
+		b.inPara = true
+	}
+}
+
+// closePara ends the open paragraph, if any.
+func (b *fb2Builder) closePara() {
+	if b.inPara {
+		b.buf.WriteString("</p>")
+		b.inPara = false
+	}
+}
+
+// content writes the blocks of an HTML fragment.
+func (b *fb2Builder) content(fragment string) error {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(sectionHTML(fragment)))
+	if err != nil {
+		return fmt.Errorf("failed to parse section HTML: %w", err)
+	}
+	start := b.buf.Len()
+	b.blocks(doc.Find("body"))
+	b.closePara()
+	// A section needs at least one block.
+	if b.buf.Len() == start {
+		b.buf.WriteString("<empty-line/>")
+	}
+	return nil
+}
+
+// openSection starts a section, titled unless title is empty.
+func (b *fb2Builder) openSection(id, title string) {
+	b.buf.WriteString("<section")
+	if id != "" {
+		b.buf.WriteString(` id="` + fb2Escape(id) + `"`)
+	}
+	b.buf.WriteString(">")
+	if strings.TrimSpace(title) != "" {
+		b.buf.WriteString("<title><p>" + fb2Escape(title) + "</p></title>")
+	}
+}
+
+// closeSection ends the innermost open section.
+func (b *fb2Builder) closeSection() {
+	b.buf.WriteString("</section>")
+}
+
+// section writes a section holding the blocks of an HTML fragment.
+func (b *fb2Builder) section(id, title, fragment string) error {
+	b.openSection(id, title)
+	if err := b.content(fragment); err != nil {
+		return err
+	}
+	b.closeSection()
+	return nil
+}
+
+// blocks writes the children of s as blocks.
+func (b *fb2Builder) blocks(s *goquery.Selection) {
+	s.Contents().Each(func(i int, n *goquery.Selection) {
+		b.block(n)
+	})
+}
+
+// block writes one node in block context. Loose text and inline elements
+// go into the current paragraph, which is opened on demand.
+func (b *fb2Builder) block(n *goquery.Selection) {
+	switch goquery.NodeName(n) {
+	case "#comment", "head", "script", "style", "noscript", "iframe", "svg":
+	case "#text":
+		text := whitespacePattern.ReplaceAllString(n.Text(), " ")
+		if !b.inPara {
+			text = strings.TrimLeft(text, " ")
+			if text == "" {
+				return
+			}
+		}
+		b.openPara()
+		b.buf.WriteString(fb2Escape(text))
+	case "br":
+		b.closePara()
+	case "hr":
+		b.closePara()
+		b.buf.WriteString("<empty-line/>")
+	case "img":
+		// Citations only take images inside paragraphs.
+		if b.inCite {
+			b.openPara()
+			b.image(n)
+			return
+		}
+		b.closePara()
+		b.image(n)
+	case "h1", "h2", "h3", "h4", "h5", "h6":
+		b.closePara()
+		if strings.TrimSpace(n.Text()) == "" {
+			return
+		}
+		b.buf.WriteString("<subtitle")
+		if id := n.AttrOr("id", ""); id != "" && !b.inCite {
+			b.buf.WriteString(` id="` + fb2Escape(id) + `"`)
+		}
+		b.buf.WriteString(">")
+		b.inlines(n)
+		b.buf.WriteString("</subtitle>")
+	case "pre":
+		b.closePara()
+		b.preformatted(n)
+	case "blockquote":
+		b.closePara()
+		// Citations do not nest; inner quotes join the outer one.
+		if b.inCite {
+			b.blocks(n)
+			b.closePara()
+			return
+		}
+		b.buf.WriteString("<cite>")
+		b.inCite = true
+		start := b.buf.Len()
+		b.blocks(n)
+		b.closePara()
+		if b.buf.Len() == start {
+			b.buf.WriteString("<empty-line/>")
+		}
+		b.inCite = false
+		b.buf.WriteString("</cite>")
+	case "table":
+		b.closePara()
+		b.table(n)
+	case "ul", "ol":
+		b.closePara()
+		b.list(n)
+	case "figcaption":
+		b.closePara()
+		if strings.TrimSpace(n.Text()) == "" {
+			return
+		}
+		b.buf.WriteString("<p><emphasis>")
+		b.inlines(n)
+		b.buf.WriteString("</emphasis></p>")
+	case "p", "div", "section", "article", "main", "header", "footer", "aside", "nav",
+		"figure", "li", "dl", "dt", "dd", "details", "summary", "center", "address":
+		b.closePara()
+		b.blocks(n)
+		b.closePara()
+	default:
+		if strings.TrimSpace(n.Text()) == "" && n.Find("img").Length() == 0 && !n.Is("img") {
+			if b.inPara {
+				b.buf.WriteString(" ")
+			}
+			return
+		}
+		b.openPara()
+		b.inline(n)
+	}
+}
+
+// preformatted writes a code block line by line, keeping the indentation
+// with no-break spaces, since FB2 readers collapse whitespace.
+func (b *fb2Builder) preformatted(n *goquery.Selection) {
+	lines := strings.Split(strings.Trim(n.Text(), "\n"), "\n")
+	for _, line := range lines {
+		line = strings.TrimRight(strings.ReplaceAll(line, "\t", "    "), " \r")
+		if line == "" {
+			b.buf.WriteString("<empty-line/>")
+			continue
+		}
+		trimmed := strings.TrimLeft(line, " ")
+		indent := strings.Repeat("\u00a0", len(line)-len(trimmed))
+		b.buf.WriteString("<p><code>" + indent + fb2Escape(trimmed) + "</code></p>")
+	}
+}
+
+// list writes every item of a list as a paragraph, marked with a bullet
+// or, for ordered lists, its number.
+func (b *fb2Builder) list(n *goquery.Selection) {
+	number := 1
+	ordered := n.Is("ol")
+	n.ChildrenFiltered("li").Each(func(i int, item *goquery.Selection) {
+		marker := "• "
+		if ordered {
+			marker = fmt.Sprintf("%d. ", number)
+			number++
+		}
+		b.marker = marker
+		b.blocks(item)
+		b.closePara()
+		b.marker = ""
+	})
+}
+
+// table writes an HTML table as an FB2 table. FB2 cells only take inline
+// content, so blocks within a cell are run together.
+func (b *fb2Builder) table(n *goquery.Selection) {
+	rows := n.Find("tr")
+	if rows.Length() == 0 {
+		return
+	}
+	b.buf.WriteString("<table>")
+	rows.Each(func(i int, row *goquery.Selection) {
+		b.buf.WriteString("<tr>")
+		row.ChildrenFiltered("th, td").Each(func(j int, cell *goquery.Selection) {
+			tag := goquery.NodeName(cell)
+			b.buf.WriteString("<" + tag)
+			for _, attr := range []string{"colspan", "rowspan"} {
+				if v := cell.AttrOr(attr, ""); v != "" {
+					b.buf.WriteString(" " + attr + `="` + fb2Escape(v) + `"`)
+				}
+			}
+			b.buf.WriteString(">")
+			b.inlines(cell)
+			b.buf.WriteString("</" + tag + ">")
+		})
+		b.buf.WriteString("</tr>")
+	})
+	b.buf.WriteString("</table>")
+}
+
+// inlines writes the children of s as inline content.
+func (b *fb2Builder) inlines(s *goquery.Selection) {
+	s.Contents().Each(func(i int, n *goquery.Selection) {
+		b.inline(n)
+	})
+}
+
+// inline writes one node in inline context, mapping the HTML text styles
+// onto their FB2 counterparts and dropping the rest of the markup.
+func (b *fb2Builder) inline(n *goquery.Selection) {
+	name := goquery.NodeName(n)
+	switch name {
+	case "#comment", "script", "style", "svg":
+	case "#text":
+		b.buf.WriteString(fb2Escape(whitespacePattern.ReplaceAllString(n.Text(), " ")))
+	case "br":
+		b.buf.WriteString(" ")
+	case "img":
+		b.image(n)
+	case "em", "i", "cite", "var", "dfn":
+		b.styled("emphasis", n)
+	case "strong", "b":
+		b.styled("strong", n)
+	case "s", "del", "strike":
+		b.styled("strikethrough", n)
+	case "code", "kbd", "samp", "tt":
+		b.styled("code", n)
+	case "sub":
+		b.styled("sub", n)
+	case "sup":
+		// Footnote markers are note links, which readers raise themselves.
+		if n.HasClass("footnote-ref") {
+			b.inlines(n)
+			return
+		}
+		b.styled("sup", n)
+	case "a":
+		href := strings.TrimSpace(n.AttrOr("href", ""))
+		if href == "" {
+			b.inlines(n)
+			return
+		}
+		b.buf.WriteString(`<a l:href="` + fb2Escape(href) + `"`)
+		if n.Parent().HasClass("footnote-ref") {
+			b.buf.WriteString(` type="note"`)
+		}
+		b.buf.WriteString(">")
+		b.inlines(n)
+		b.buf.WriteString("</a>")
+	default:
+		b.inlines(n)
+	}
+}
+
+// styled writes the children of n wrapped in the FB2 element tag.
+func (b *fb2Builder) styled(tag string, n *goquery.Selection) {
+	b.buf.WriteString("<" + tag + ">")
+	b.inlines(n)
+	b.buf.WriteString("</" + tag + ">")
+}
+
+// image writes a reference to the image of an <img>, or its alt text in
+// brackets when the image was not embedded.
+func (b *fb2Builder) image(n *goquery.Selection) {
+	if id := b.binary(n.AttrOr("src", "")); id != "" {
+		b.buf.WriteString(`<image l:href="#` + id + `"/>`)
+		return
+	}
+	if alt := strings.TrimSpace(n.AttrOr("alt", "")); alt != "" {
+		if !b.inPara && !b.inCite {
+			b.openPara()
+			defer b.closePara()
+		}
+		b.buf.WriteString(fb2Escape("[" + alt + "]"))
+	}
+}
+
+// notes writes the notes body the footnote markers point to.
+func (b *fb2Builder) notes(refs *references) {
+	b.buf.WriteString(`<body name="notes"><title><p>References</p></title>`)
+	for i, u := range refs.urls {
+		escaped := fb2Escape(u)
+		fmt.Fprintf(&b.buf, `<section id="ref-%d"><title><p>%d</p></title><p><a l:href="%s">%s</a></p></section>`, i+1, i+1, escaped, escaped)
+	}
+	b.buf.WriteString("</body>")
+}
+
+// document wraps the written bodies into a complete FictionBook file
+// described by m, with the images at the end.
+func (b *fb2Builder) document(m fb2Meta) string {
+	var doc strings.Builder
+	doc.WriteString(`<?xml version="1.0" encoding="UTF-8"?>` + "\n")
+	doc.WriteString(`<FictionBook xmlns="http://www.gribuser.ru/xml/fictionbook/2.0" xmlns:l="http://www.w3.org/1999/xlink">` + "\n")
+	doc.WriteString("<description><title-info><genre>computers</genre>")
+	doc.WriteString("<author><nickname>" + fb2Escape(m.author) + "</nickname></author>")
+	doc.WriteString("<book-title>" + fb2Escape(m.title) + "</book-title>")
+	if m.summary != "" {
+		doc.WriteString("<annotation><p>" + fb2Escape(m.summary) + "</p></annotation>")
+	}
+	if len(m.subjects) > 0 {
+		doc.WriteString("<keywords>" + fb2Escape(strings.Join(m.subjects, ", ")) + "</keywords>")
+	}
+	if len(m.published) >= len("2006-01-02") {
+		date := m.published[:len("2006-01-02")]
+		doc.WriteString(`<date value="` + date + `">` + date + "</date>")
+	}
+	if id := b.binary(m.cover); id != "" {
+		doc.WriteString(`<coverpage><image l:href="#` + id + `"/></coverpage>`)
+	}
+	doc.WriteString("<lang>" + fb2Escape(m.lang) + "</lang></title-info>")
+	today := time.Now().Format("2006-01-02")
+	doc.WriteString("<document-info><author><nickname>habrdownloader</nickname></author><program-used>habrdownloader</program-used>")
+	doc.WriteString(`<date value="` + today + `">` + today + "</date>")
+	doc.WriteString("<src-url>" + fb2Escape(m.source) + "</src-url>")
+	doc.WriteString("<id>" + fb2Escape(m.id) + "</id><version>1.0</version></document-info></description>\n")
+	doc.WriteString(b.buf.String())
+	for _, bin := range b.binaries {
+		fmt.Fprintf(&doc, "\n"+`<binary id="%s" content-type="%s">%s</binary>`, bin.id, fb2Escape(bin.contentType), bin.data)
+	}
+	doc.WriteString("\n</FictionBook>\n")
+	return doc.String()
+}
+
+// fb2Book writes the body of an FB2 book: a section per part, or for a
+// single article a section per chapter, mirroring the EPUB layout, and
+// the notes body for the footnotes.
+func fb2Book(title string, parts []*part, rendered []renderedPart, appendix string, refs *references, opts *Options) (*fb2Builder, error) {
+	b := &fb2Builder{}
+	b.buf.WriteString("<body><title><p>" + fb2Escape(title) + "</p></title>")
+	for i, r := range rendered {
+		chapterTitle := r.title
+		if strings.TrimSpace(chapterTitle) == "" {
+			chapterTitle = "Article"
+		}
+		chapters := []chapter{{body: r.body}}
+		if opts.SplitHeadings {
+			if split := splitByHeading(parts[i].doc, chapterTitle); len(split) > 1 {
+				chapters = split
+			}
+		}
+		chapters[len(chapters)-1].body += r.footer
+		if r.comments != "" {
+			chapters = append(chapters, chapter{title: "Comments", body: r.comments})
+		}
+
+		// A section holds either blocks or sections, so a part with
+		// several chapters nests them.
+		if len(rendered) > 1 {
+			b.openSection(partAnchor(i), chapterTitle)
+			if len(chapters) == 1 {
+				if err := b.content(chapters[0].body); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(rendered) == 1 || len(chapters) > 1 {
+			for _, ch := range chapters {
+				if err := b.section("", ch.title, ch.body); err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(rendered) > 1 {
+			b.closeSection()
+		}
+	}
+	if appendix != "" {
+		if err := b.section("", "Other parts in this series", appendix); err != nil {
+			return nil, err
+		}
+	}
+	b.buf.WriteString("</body>")
+	if len(refs.urls) > 0 {
+		b.notes(refs)
+	}
+	return b, nil
+}
+
+// fb2Cover returns the cover of an FB2 book as a data: URI: the page's
+// Open Graph image, else the first image embedded in doc, else a cover
+// drawn from text, which Options.GenerateCover always uses.
+func fb2Cover(ctx context.Context, page, doc *goquery.Document, base *url.URL, text coverText, opts *Options) string {
+	if !opts.GenerateCover {
+		if coverURL := extractCoverURL(page, base); coverURL != nil {
+			data, ext, err := opts.fetchBinary(ctx, coverURL.String())
+			if err == nil && ext == ".webp" {
+				data, ext, err = transcodeWebP(data, "auto", 0)
+			}
+			if err == nil && ext != ".jpg" && ext != ".png" && ext != ".gif" {
+				err = errors.New("not a JPEG, PNG or GIF image")
+			}
+			if err == nil {
+				opts.debugf("fetched cover %s (%d bytes)", coverURL, len(data))
+				return dataURI(shrinkImage(data, ext, coverWidth, opts.JPEGQuality, opts.Grayscale), ext)
+			}
+			opts.logf("warning: failed to embed cover %s: %v", coverURL, err)
+		}
+		if src := doc.Find(`img[src^="data:image/"]`).First().AttrOr("src", ""); src != "" {
+			return src
+		}
+	}
+	data, err := drawCover(text)
+	if err != nil {
+		opts.logf("warning: failed to generate cover: %v", err)
+		return ""
+	}
+	return dataURI(shrinkImage(data, ".png", 0, 0, opts.Grayscale), ".png")
+}
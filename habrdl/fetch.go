@@ -0,0 +1,369 @@
+package habrdl
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/time/rate"
+)
+
+// DefaultUserAgent mimics a desktop browser; Habr serves a challenge page
+// to the stock Go client for some articles.
+const DefaultUserAgent = "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0 Safari/537.36"
+
+// Fetcher downloads pages and images, retrying transient failures with
+// exponential backoff.
+type Fetcher struct {
+	// Client performs the requests; http.DefaultClient is used when nil.
+	Client *http.Client
+	// UserAgent is sent with every request.
+	UserAgent string
+	// Timeout bounds every request, including reading the response body.
+	Timeout time.Duration
+	// Retries is how many times a failed request is retried.
+	Retries int
+	// RetryDelay is the wait before the first retry; it doubles on each attempt.
+	RetryDelay time.Duration
+	// Limiter, if set, paces every request attempt, including retries and
+	// concurrent image downloads, so one limiter can span a whole batch.
+	Limiter *rate.Limiter
+	// Cookie is sent as the Cookie header, but only to Habr hosts, so
+	// that a logged-in session can download members-only posts.
+	Cookie string
+	// CacheDir, if set, keeps downloaded binaries such as images, so that
+	// repeated banners and avatars of a batch are fetched only once.
+	CacheDir string
+	// Logf, if set, is told about every retry.
+	Logf func(format string, args ...interface{})
+}
+
+// NewFetcher returns a Fetcher that sends its requests through client,
+// with the same defaults as the command-line tool.
+func NewFetcher(client *http.Client) *Fetcher {
+	return &Fetcher{
+		Client:     client,
+		UserAgent:  DefaultUserAgent,
+		Timeout:    30 * time.Second,
+		Retries:    3,
+		RetryDelay: 500 * time.Millisecond,
+	}
+}
+
+// ProxyClient returns an HTTP client that sends every request through the
+// proxy at proxyURL (http://, https:// or socks5://). Without a proxy the
+// default client is used, which honors HTTP_PROXY and HTTPS_PROXY.
+func ProxyClient(proxyURL string) (*http.Client, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (want http, https or socks5)", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", proxyURL)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(u)
+	return &http.Client{Transport: transport}, nil
+}
+
+// ErrAccessDenied and ErrRateLimited match, through errors.Is, the errors
+// of downloads the server refused for want of a login or for too many
+// requests.
+var (
+	ErrAccessDenied = errors.New("access denied")
+	ErrRateLimited  = errors.New("rate limited")
+)
+
+// httpStatusError is returned when the server answers with a status other than 200 OK.
+type httpStatusError struct {
+	StatusCode int
+	// Page is set for article pages, whose 404 means the article is gone.
+	Page bool
+}
+
+func (e *httpStatusError) Error() string {
+	switch {
+	case e.StatusCode == http.StatusNotFound && e.Page:
+		return "article not found, it may have been deleted (HTTP 404)"
+	case e.StatusCode == http.StatusNotFound:
+		return "not found (HTTP 404)"
+	case e.StatusCode == http.StatusForbidden:
+		return "access denied, login may be required (HTTP 403)"
+	case e.StatusCode == http.StatusTooManyRequests:
+		return "rate limited by Habr (HTTP 429)"
+	default:
+		return fmt.Sprintf("unexpected HTTP status: %d", e.StatusCode)
+	}
+}
+
+// Is matches ErrAccessDenied to 401 and 403 answers and ErrRateLimited to
+// 429 ones.
+func (e *httpStatusError) Is(target error) bool {
+	switch target {
+	case ErrAccessDenied:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// retryable reports whether a failed request may succeed when repeated:
+// network errors, timeouts, cut-off bodies, 429 Too Many Requests and 5xx
+// responses are retried. Other 4xx responses, cancellation and bodies
+// that cannot be decoded are not, since they would fail the same way.
+func retryable(err error) bool {
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true
+	}
+	// The client reports every failure as a *url.Error, itself a net.Error.
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// imageAccept is the Accept header of image requests. It leaves out AVIF,
+// which nothing here can convert, so CDNs that negotiate the format send
+// one that readers show or that can be transcoded.
+const imageAccept = "image/jpeg,image/png,image/gif,image/svg+xml,image/webp;q=0.8,*/*;q=0.5"
+
+// fetch performs a GET request and returns the response body and headers,
+// retrying transient failures with exponential backoff. A non-empty
+// accept is sent as the Accept header.
+func (f *Fetcher) fetch(ctx context.Context, resourceURL, accept string) ([]byte, http.Header, error) {
+	delay := f.RetryDelay
+	for attempt := 0; ; attempt++ {
+		data, header, err := f.fetchOnce(ctx, resourceURL, accept)
+		if err == nil || attempt >= f.Retries || !retryable(err) || ctx.Err() != nil {
+			return data, header, err
+		}
+		if f.Logf != nil {
+			f.Logf("retrying %s in %s (attempt %d/%d): %v", resourceURL, delay, attempt+1, f.Retries, err)
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// fetchOnce performs a single GET request. Any status other than 200 OK is
+// reported as an *httpStatusError.
+func (f *Fetcher) fetchOnce(ctx context.Context, resourceURL, accept string) ([]byte, http.Header, error) {
+	if f.Limiter != nil {
+		if err := f.Limiter.Wait(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+	if f.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.Timeout)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, resourceURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", f.UserAgent)
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	req.Header.Set("Accept-Language", "ru,en")
+	// Setting Accept-Encoding turns off the transport's own gzip handling,
+	// so every encoding offered here is decoded by decodeBody.
+	req.Header.Set("Accept-Encoding", "gzip, deflate, br")
+	if cookie := f.cookieFor(resourceURL); cookie != "" {
+		req.Header.Set("Cookie", cookie)
+	}
+
+	client := f.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, f.timeoutError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, &httpStatusError{StatusCode: resp.StatusCode}
+	}
+
+	body, err := decodeBody(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer body.Close()
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, nil, f.timeoutError(err)
+	}
+	return data, resp.Header, nil
+}
+
+// decodeBody wraps the response body in a reader undoing its
+// Content-Encoding. Habr's CDN answers with Brotli when it is offered.
+func decodeBody(resp *http.Response) (io.ReadCloser, error) {
+	switch encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding {
+	case "", "identity":
+		return io.NopCloser(resp.Body), nil
+	case "gzip", "x-gzip":
+		r, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode gzip response: %w", err)
+		}
+		return r, nil
+	case "deflate":
+		// "deflate" is meant to be zlib-wrapped, but some servers send a raw
+		// stream; peek at the header to tell them apart.
+		br := bufio.NewReader(resp.Body)
+		if header, err := br.Peek(2); err == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			r, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode deflate response: %w", err)
+			}
+			return r, nil
+		}
+		return flate.NewReader(br), nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(resp.Body)), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+}
+
+// timeoutError replaces a raw deadline error with a readable message, which
+// still matches context.DeadlineExceeded.
+func (f *Fetcher) timeoutError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &requestTimeoutError{timeout: f.Timeout, err: err}
+	}
+	return err
+}
+
+// requestTimeoutError is a request that ran out of Fetcher.Timeout.
+type requestTimeoutError struct {
+	timeout time.Duration
+	err     error
+}
+
+func (e *requestTimeoutError) Error() string {
+	return fmt.Sprintf("request timed out after %s", e.timeout)
+}
+
+func (e *requestTimeoutError) Unwrap() error { return e.err }
+
+// FetchURL downloads the content of the given URL and returns it as a byte slice.
+func (f *Fetcher) FetchURL(ctx context.Context, url string) ([]byte, error) {
+	data, _, err := f.fetch(ctx, url, "")
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) {
+		statusErr.Page = true
+	}
+	return data, err
+}
+
+// extForContentType maps an image media type to a file extension, or
+// returns an empty string for anything else.
+func extForContentType(ct string) string {
+	switch {
+	case strings.Contains(ct, "jpeg"), strings.Contains(ct, "jpg"):
+		return ".jpg"
+	case strings.Contains(ct, "png"):
+		return ".png"
+	case strings.Contains(ct, "gif"):
+		return ".gif"
+	case strings.Contains(ct, "webp"):
+		return ".webp"
+	case strings.Contains(ct, "avif"):
+		return ".avif"
+	case strings.Contains(ct, "svg"):
+		return ".svg"
+	default:
+		return ""
+	}
+}
+
+// sniffImageExt recognizes the formats http.DetectContentType does not:
+// AVIF by its ftyp box and SVG, which it reports as XML or plain text.
+func sniffImageExt(data []byte) string {
+	if len(data) >= 12 && string(data[4:8]) == "ftyp" && (string(data[8:12]) == "avif" || string(data[8:12]) == "avis") {
+		return ".avif"
+	}
+	head := data
+	if len(head) > 1024 {
+		head = head[:1024]
+	}
+	head = bytes.TrimLeft(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf")), " \t\r\n")
+	if bytes.HasPrefix(head, []byte("<svg")) || (bytes.HasPrefix(head, []byte("<?xml")) || bytes.HasPrefix(head, []byte("<!DOCTYPE svg"))) && bytes.Contains(head, []byte("<svg")) {
+		return ".svg"
+	}
+	return ""
+}
+
+// FetchBinary downloads binary content (e.g., images) and returns the data and a guessed file extension.
+func (f *Fetcher) FetchBinary(ctx context.Context, resourceURL string) ([]byte, string, error) {
+	var data []byte
+	var contentType string
+	cached := false
+	if f.CacheDir != "" {
+		data, contentType, cached = f.cachedBinary(resourceURL)
+	}
+	if !cached {
+		var header http.Header
+		var err error
+		data, header, err = f.fetch(ctx, resourceURL, imageAccept)
+		if err != nil {
+			return nil, "", err
+		}
+		contentType = header.Get("Content-Type")
+		if f.CacheDir != "" {
+			if err := f.storeBinary(resourceURL, data, contentType); err != nil && f.Logf != nil {
+				f.Logf("warning: failed to cache %s: %v", resourceURL, err)
+			}
+		}
+	}
+
+	ext := extForContentType(contentType)
+	if ext == "" {
+		// Some CDNs send application/octet-stream or nothing at all;
+		// fall back to the file's magic numbers.
+		ext = extForContentType(http.DetectContentType(data))
+	}
+	if ext == "" {
+		ext = sniffImageExt(data)
+	}
+
+	return data, ext, nil
+}
@@ -0,0 +1,75 @@
+package habrdl
+
+import (
+	"bytes"
+	_ "embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// fontFamily is the family name the embedded font is registered under.
+const fontFamily = "BookFont"
+
+// BuiltinFont, given as Options.FontFile, embeds the bundled Go Regular
+// font, which covers Cyrillic, instead of a font file.
+const BuiltinFont = "builtin"
+
+// goFontLicense is the license of the Go fonts, which a book carrying
+// BuiltinFont reproduces in its stylesheet.
+//
+//go:embed fonts/LICENSE
+var goFontLicense string
+
+// fontSignatures maps the leading bytes of a font file to its extension.
+var fontSignatures = []struct {
+	magic []byte
+	ext   string
+}{
+	{[]byte{0x00, 0x01, 0x00, 0x00}, ".ttf"},
+	{[]byte("true"), ".ttf"},
+	{[]byte("OTTO"), ".otf"},
+	{[]byte("wOFF"), ".woff"},
+	{[]byte("wOF2"), ".woff2"},
+}
+
+// readFont reads a TrueType, OpenType or WOFF font and returns its data and
+// the extension matching its actual format.
+func readFont(path string) ([]byte, string, error) {
+	if path == BuiltinFont {
+		return goregular.TTF, ".ttf", nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	for _, sig := range fontSignatures {
+		if bytes.HasPrefix(data, sig.magic) {
+			return data, sig.ext, nil
+		}
+	}
+	return nil, "", fmt.Errorf("%s is not a TrueType or OpenType font", filepath.Base(path))
+}
+
+// fontCSS returns the rules that make the font at src the body font. The
+// bundled font, read from path BuiltinFont, comes with its license.
+func fontCSS(path, src string) string {
+	css := fmt.Sprintf("@font-face {\n  font-family: %q;\n  src: url(%q);\n}\nbody {\n  font-family: %q, serif;\n}\n",
+		fontFamily, src, fontFamily)
+	if path == BuiltinFont {
+		css = "/*\n" + goFontLicense + "*/\n" + css
+	}
+	return css
+}
+
+// fontFileName is the name the font is stored under inside the book.
+func fontFileName(path, ext string) string {
+	if path == BuiltinFont {
+		return "Go-Regular" + ext
+	}
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	return sanitizeFileName(name, "_") + ext
+}
@@ -0,0 +1,43 @@
+package habrdl
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestBuiltinFont(t *testing.T) {
+	data, ext, err := readFont(BuiltinFont)
+	if err != nil || ext != ".ttf" || len(data) == 0 {
+		t.Fatalf("readFont(BuiltinFont) = %d bytes, %q, %v", len(data), ext, err)
+	}
+	if name := fontFileName(BuiltinFont, ext); name != "Go-Regular.ttf" {
+		t.Errorf("fontFileName = %q, want Go-Regular.ttf", name)
+	}
+	css := fontCSS(BuiltinFont, "../fonts/Go-Regular.ttf")
+	if !strings.HasPrefix(css, "/*") || !strings.Contains(css, "Bigelow & Holmes") {
+		t.Errorf("stylesheet of the bundled font lacks its license:\n%s", css)
+	}
+	if css := fontCSS("my.ttf", "../fonts/my.ttf"); strings.Contains(css, "Bigelow") {
+		t.Errorf("stylesheet of a font file carries the Go fonts license:\n%s", css)
+	}
+}
+
+func TestBuiltinFontInHTML(t *testing.T) {
+	articleURL := serveArticle(t, "100", "testdata/table_article.html")
+	opts := Options{Fetcher: NewFetcher(nil), AllowAnyHost: true, Format: "html", FontFile: BuiltinFont, Logf: t.Logf}
+	opts.Fetcher.Retries = 0
+	book, err := Convert(context.Background(), articleURL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer book.Close()
+	var buf bytes.Buffer
+	if _, err := book.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if out := buf.String(); !strings.Contains(out, "@font-face") || !strings.Contains(out, "Bigelow & Holmes") {
+		t.Error("html book does not embed the bundled font with its license")
+	}
+}
@@ -0,0 +1,69 @@
+package habrdl
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// referencesFile is the name of the EPUB section the footnotes point to.
+const referencesFile = "references.xhtml"
+
+// references numbers the external URLs of a book in order of first use.
+type references struct {
+	urls  []string
+	index map[string]int
+}
+
+// number returns the footnote number of u, assigning the next one when u
+// is new.
+func (r *references) number(u string) int {
+	if n, ok := r.index[u]; ok {
+		return n
+	}
+	if r.index == nil {
+		r.index = make(map[string]int)
+	}
+	r.urls = append(r.urls, u)
+	r.index[u] = len(r.urls)
+	return len(r.urls)
+}
+
+// footnoteLinks replaces the external links of doc with their text and a
+// numbered marker pointing at the entry for the URL in target, the
+// references section. Anchor links within the article are left alone.
+// It returns the number of rewritten links.
+func footnoteLinks(doc *goquery.Document, refs *references, target string) int {
+	rewritten := 0
+	doc.Find("a[href]").Each(func(i int, s *goquery.Selection) {
+		href := strings.TrimSpace(s.AttrOr("href", ""))
+		u, err := url.Parse(href)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return
+		}
+		n := refs.number(href)
+		inner, err := s.Html()
+		if err != nil {
+			return
+		}
+		s.ReplaceWithHtml(fmt.Sprintf(`%s<sup class="footnote-ref"><a href="%s#ref-%d">[%d]</a></sup>`, inner, target, n, n))
+		rewritten++
+	})
+	return rewritten
+}
+
+// referencesHTML renders the numbered list of URLs the footnotes point to.
+func referencesHTML(refs *references) string {
+	var buf bytes.Buffer
+	buf.WriteString(`<h2>References</h2><ol class="references">`)
+	for i, u := range refs.urls {
+		escaped := html.EscapeString(u)
+		fmt.Fprintf(&buf, `<li id="ref-%d"><a href="%s">%s</a></li>`, i+1, escaped, escaped)
+	}
+	buf.WriteString("</ol>")
+	return buf.String()
+}
@@ -0,0 +1,1200 @@
+// Package habrdl downloads Habr articles and converts them into EPUB or
+// FB2 books, standalone HTML pages or Markdown notes.
+package habrdl
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/bmaupin/go-epub"
+	"github.com/go-shiori/go-readability"
+	"github.com/gofrs/uuid"
+)
+
+// Options controls how an article is converted. The zero value produces
+// an EPUB with default settings.
+type Options struct {
+	// Fetcher downloads the page and its resources; NewFetcher(nil) is used when nil.
+	Fetcher *Fetcher
+	// Format is "epub" (the default), "html" for a single file with inlined
+	// images, "fb2" for a FictionBook 2 file, "md" for Markdown with the
+	// images in an assets folder next to it, "txt" for plain text without
+	// images, "json" for the parsed article as data, or "mobi", "azw3" or
+	// "pdf", which are converted from the EPUB by ebook-convert or, for
+	// mobi, kindlegen.
+	Format string
+	// Kepub writes the epub format in Kobo's kepub flavor, with every
+	// sentence in a koboSpan, as a .kepub.epub file.
+	Kepub bool
+	// EPUB3 writes the sections of EPUB books as strict EPUB 3 content:
+	// well-formed XHTML in <section> elements with epub:type semantics,
+	// noteref footnotes and a landmarks navigation.
+	EPUB3 bool
+	// KeepEPUB makes ConvertToFile also keep the intermediate EPUB of a
+	// mobi, azw3 or pdf book next to it.
+	KeepEPUB bool
+	// PageFile, if set, is a saved copy of the article page (optionally
+	// gzipped) that is converted instead of downloading the URL, which then
+	// only serves as the base for links and the attribution. Images next to
+	// the file are read from disk; remote ones are still downloaded.
+	PageFile string
+	// Concurrency is the number of images downloaded in parallel.
+	Concurrency int
+	// WebPMode is "auto" (the default), which transcodes still WebP images
+	// to PNG or, for lossy photos, JPEG; "png" or "jpg" to always use that
+	// format; or "keep" to leave them as WebP.
+	WebPMode string
+	// MinImageSize drops images narrower or lower than this many pixels,
+	// such as tracking pixels and icons; 0 keeps them all.
+	MinImageSize int
+	// MinImageBytes drops images smaller than this many bytes; 0 keeps them
+	// all.
+	MinImageBytes int
+	// GIFMode is "keep" (the default) to embed animated GIFs as they are,
+	// or "first-frame" to embed the first frame as a PNG.
+	GIFMode string
+	// MaxImageWidth downscales wider JPEG and PNG images; 0 keeps the original size.
+	MaxImageWidth int
+	// JPEGQuality, between 1 and 100, re-encodes JPEG images at that
+	// quality when it makes them smaller; 0 re-encodes only downscaled ones,
+	// at 85.
+	JPEGQuality int
+	// Grayscale converts JPEG, PNG and still GIF images to 8-bit
+	// grayscale, for e-ink readers.
+	Grayscale bool
+	// StrictImages fails the conversion if any image cannot be embedded.
+	StrictImages bool
+	// NoImages skips all images, keeping only their alt text.
+	NoImages bool
+	// SeriesLinks appends links to the other parts of the article series.
+	SeriesLinks bool
+	// AllowAnyHost accepts article URLs on hosts other than habr.com.
+	AllowAnyHost bool
+	// HighlightStyle names the chroma style the code blocks of EPUB and
+	// html books are colored with (see HighlightStyleExists); empty leaves
+	// them plain.
+	HighlightStyle string
+	// CSSFile replaces the bundled stylesheet.
+	CSSFile string
+	// PruneCSS drops the rules of the stylesheet whose classes and IDs no
+	// element of the book carries.
+	PruneCSS bool
+	// SplitHeadings gives every <h2> and <h3> heading its own EPUB
+	// section, with the <h3> ones nested below their <h2> in the table of
+	// contents.
+	SplitHeadings bool
+	// Comments appends the article comments as a separate section.
+	Comments bool
+	// CommentsMinRating, if set, drops comments rated below it, unless a
+	// reply that is kept needs them for context.
+	CommentsMinRating *int
+	// Lang overrides the detected book language.
+	Lang string
+	// NoAttribution leaves out the source/author/date footer.
+	NoAttribution bool
+	// Logf, if set, receives warnings such as skipped images.
+	Logf func(format string, args ...interface{})
+	// Debugf, if set, receives details of every download and conversion step.
+	Debugf func(format string, args ...interface{})
+	// Progress, if set, is called after each image of an article has been
+	// downloaded, with the number of finished and total downloads. Calls
+	// never overlap, even though images are fetched concurrently.
+	Progress func(done, total int)
+	// SVGMode is what happens to inline <svg> drawings: "raster" (the
+	// default) embeds them as PNG images, "inline" keeps them in the text.
+	SVGMode string
+	// SVGImageWidth rasterizes downloaded SVG images to PNGs this many
+	// pixels wide; 0 keeps them as SVG.
+	SVGImageWidth int
+	// Spoilers is what happens to Habr's spoilers: "expand" (the default)
+	// shows them as open boxes titled in bold, "details" turns them into
+	// <details> elements that EPUB 3 readers can fold.
+	Spoilers string
+	// Math is how formulas are kept: "tex" (the default) shows the TeX
+	// source of KaTeX formulas and of Habr's formula images as code,
+	// "mathml" keeps the MathML of KaTeX and the formula images.
+	Math string
+	// Anthology adds these articles after the one being converted, as
+	// further parts of the same book with one chapter each.
+	Anthology []string
+	// Title replaces the book title, which is otherwise the title of the
+	// first article.
+	Title string
+	// Series follows the series navigation of the article and puts every
+	// part into the book, ordered by article ID.
+	Series bool
+	// Depth follows links to other Habr articles in the text this many
+	// levels deep, adding every linked article as a further part of the
+	// book; links between parts then point inside the book.
+	Depth int
+	// PreferAPI takes articles from Habr's article API first, which serves
+	// the clean text and metadata, and only scrapes the page when the API
+	// fails.
+	PreferAPI bool
+	// NoFallback disables the retry through Habr's article API when the
+	// page yields suspiciously little text.
+	NoFallback bool
+	// NoEmbedCode leaves gist and CodePen embeds as links, without
+	// fetching their source into the book.
+	NoEmbedCode bool
+	// NoFrontPage leaves out the first EPUB section, which lists the
+	// source, author, date, hubs, tags, rating and reading time.
+	NoFrontPage bool
+	// NoReadingTime leaves out the word count and reading time line at the
+	// top of the article.
+	NoReadingTime bool
+	// FontFile is a TrueType or OpenType font embedded as the body font,
+	// or BuiltinFont for the bundled one.
+	FontFile string
+	// Strip lists extra CSS selectors of page blocks to drop before the
+	// article is extracted, on top of the built-in Habr interface blocks.
+	Strip []string
+	// Footnotes replaces external links in the article text with numbered
+	// markers and lists their URLs in a References section at the end.
+	Footnotes bool
+	// MinContentLength is the number of characters readability expects of
+	// an article before it relaxes its cleanup and retries; 0 keeps its
+	// default of 500.
+	MinContentLength int
+	// KeepFigures unwraps the divs around figures before extraction, so
+	// readability does not drop images with short captions with them.
+	KeepFigures bool
+	// RandomIdentifier gives the EPUB a random UUID instead of the stable
+	// identifier derived from the article, so every download is a new book.
+	RandomIdentifier bool
+	// NoCover leaves the EPUB without a cover image.
+	NoCover bool
+	// GenerateCover always uses a cover drawn with the title, author and
+	// date, which otherwise only books without any image get.
+	GenerateCover bool
+	// NameTemplate names the output file of ConvertToFile; see renderFileName
+	// for the placeholders. The default is "{title}".
+	NameTemplate string
+	// SpaceReplacement replaces the spaces of the output file name: "_"
+	// (the default), "-" or " " to keep them.
+	SpaceReplacement string
+	// SkipExisting makes ConvertToFile stop with ErrExists, before any
+	// image is downloaded, when the output file is already present.
+	SkipExisting bool
+
+	// checkOutput, if set, is called once the book metadata is known and
+	// may abort the conversion.
+	checkOutput func(b *Book) error
+	// inspectOnly stops the conversion once the book metadata is known.
+	inspectOnly bool
+	// binaries, if set, keeps the images downloaded for one book for the
+	// other formats built from the same download.
+	binaries *binaryMemo
+	// responses, if set, keeps the comments and embed sources fetched for
+	// one book for the other formats, like binaries.
+	responses *binaryMemo
+}
+
+// ErrExists is returned by ConvertToFile when SkipExisting is set and the
+// output file already exists.
+var ErrExists = errors.New("output file already exists")
+
+// ErrMembersOnly is returned when Habr serves the teaser of an article
+// that needs a logged-in session.
+var ErrMembersOnly = errors.New("article is for members only and requires authentication")
+
+// logf forwards to Logf when it is set.
+func (o *Options) logf(format string, args ...interface{}) {
+	if o.Logf != nil {
+		o.Logf(format, args...)
+	}
+}
+
+// documentFormats are the formats written as a single document built from
+// the article HTML rather than as an EPUB.
+var documentFormats = map[string]bool{"html": true, "fb2": true, "md": true, "txt": true, "json": true}
+
+// inlineImages reports whether the format carries its images inline as
+// data: URIs rather than as EPUB resources.
+func (o *Options) inlineImages() bool {
+	return o.Format == "html" || o.Format == "fb2"
+}
+
+// pageDir returns the absolute folder of PageFile, or "" when the page is
+// downloaded.
+func (o *Options) pageDir() string {
+	if o.PageFile == "" {
+		return ""
+	}
+	dir, err := filepath.Abs(filepath.Dir(o.PageFile))
+	if err != nil {
+		return ""
+	}
+	return dir
+}
+
+// fetchBinary downloads an image through Fetcher, or takes it from
+// binaries when an earlier format already downloaded it.
+func (o *Options) fetchBinary(ctx context.Context, resourceURL string) ([]byte, string, error) {
+	if o.binaries == nil {
+		return o.Fetcher.FetchBinary(ctx, resourceURL)
+	}
+	return o.binaries.fetch(ctx, o.Fetcher, resourceURL)
+}
+
+// fetchText downloads an API response such as the comments of an article
+// through Fetcher, or takes it from responses when an earlier format
+// already downloaded it.
+func (o *Options) fetchText(ctx context.Context, resourceURL string) ([]byte, error) {
+	if o.responses == nil {
+		data, _, err := o.Fetcher.fetch(ctx, resourceURL, "")
+		return data, err
+	}
+	return o.responses.fetchText(ctx, o.Fetcher, resourceURL)
+}
+
+// debugf forwards to Debugf when it is set.
+func (o *Options) debugf(format string, args ...interface{}) {
+	if o.Debugf != nil {
+		o.Debugf(format, args...)
+	}
+}
+
+// Book is a converted article, ready to be written. Close must be called
+// to release the temporary files it holds.
+type Book struct {
+	// Title is the article title the book is named after.
+	Title string
+	// Ext is the file extension matching the output format, e.g. ".epub".
+	Ext string
+	// Author is the article author, or "Habr" when it is not known.
+	Author string
+	// Published is the publication date as an RFC 3339 UTC timestamp, if known.
+	Published string
+	// ID is the numeric article ID from the URL, if any.
+	ID string
+	// Images is the number of images in the article text.
+	Images int
+	// Words is the number of words in the article text.
+	Words int
+	// ReadingTime is the estimated reading time in minutes.
+	ReadingTime int
+	// Parts is the number of articles in the book; more than one for a series.
+	Parts int
+
+	inspected bool
+	path      string
+	converter string
+	epub      *epub.Epub
+	opfMeta   []string
+	landmarks []landmark
+	text      string
+	tmpDir    string
+}
+
+// WriteTo writes the book to w.
+func (b *Book) WriteTo(w io.Writer) (int64, error) {
+	if b.inspected {
+		return 0, errors.New("book was only inspected and has no content")
+	}
+	if b.epub == nil {
+		n, err := io.WriteString(w, b.text)
+		return int64(n), err
+	}
+	if b.converter != "" {
+		return b.writeConverted(w)
+	}
+	return writeEPUB(w, b.epub, b.opfMeta, b.landmarks)
+}
+
+// Close removes the temporary files staged for the book.
+func (b *Book) Close() error {
+	if b.tmpDir == "" {
+		return nil
+	}
+	return os.RemoveAll(b.tmpDir)
+}
+
+// Convert downloads the article at articleURL and converts it according
+// to opts.
+func Convert(ctx context.Context, articleURL string, opts Options) (*Book, error) {
+	books, err := ConvertFormats(ctx, articleURL, []string{opts.Format}, opts)
+	if err != nil {
+		return nil, err
+	}
+	return books[0], nil
+}
+
+// ConvertFormats downloads and parses the article at articleURL once and
+// converts it into each of formats, in order, instead of opts.Format.
+// Images are downloaded once for all of the books. With SkipExisting the
+// books whose file exists are left out, and ErrExists is returned only
+// when that leaves none.
+func ConvertFormats(ctx context.Context, articleURL string, formats []string, opts Options) ([]*Book, error) {
+	if opts.Fetcher == nil {
+		opts.Fetcher = NewFetcher(nil)
+	}
+	if len(formats) == 0 {
+		formats = []string{""}
+	}
+	formats = append([]string(nil), formats...)
+	for i, format := range formats {
+		if format == "" {
+			formats[i] = "epub"
+		}
+		if formats[i] != "epub" && !documentFormats[formats[i]] && !converterFormats[formats[i]] {
+			return nil, fmt.Errorf("unsupported format %q", formats[i])
+		}
+	}
+	if opts.WebPMode == "" {
+		opts.WebPMode = "auto"
+	}
+	if opts.GIFMode == "" {
+		opts.GIFMode = "keep"
+	}
+	if opts.Math == "" {
+		opts.Math = "tex"
+	}
+	if opts.SVGMode == "" {
+		opts.SVGMode = "raster"
+	}
+	if opts.Spoilers == "" {
+		opts.Spoilers = "expand"
+	}
+	if err := checkSelectors(opts.Strip); err != nil {
+		return nil, err
+	}
+
+	var books []*Book
+	for _, format := range formats {
+		book := &Book{Ext: OutputExt(format, opts.Kepub)}
+		if converterFormats[format] && !opts.inspectOnly {
+			converter, err := findConverter(format)
+			if err != nil {
+				return nil, err
+			}
+			book.converter = converter
+		}
+		books = append(books, book)
+	}
+
+	// Check the font first; a bad file should not cost a download.
+	var fontData []byte
+	var fontExt string
+	if opts.FontFile != "" {
+		var err error
+		fontData, fontExt, err = readFont(opts.FontFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read font: %w", err)
+		}
+	}
+
+	parts, err := collectParts(ctx, articleURL, &opts)
+	if err != nil {
+		return nil, err
+	}
+	// Every book rewrites its parts, so all but the first get a copy made
+	// before any of them is built.
+	variants := [][]*part{parts}
+	for range books[1:] {
+		variants = append(variants, cloneParts(parts))
+	}
+	if len(books) > 1 {
+		opts.binaries = &binaryMemo{}
+		opts.responses = &binaryMemo{}
+	}
+
+	var built []*Book
+	for i, book := range books {
+		bookOpts := opts
+		bookOpts.Format = formats[i]
+		err := convert(ctx, book, variants[i], fontData, fontExt, &bookOpts)
+		if errors.Is(err, ErrExists) && len(books) > 1 {
+			book.Close()
+			continue
+		}
+		if err != nil {
+			book.Close()
+			for _, b := range built {
+				b.Close()
+			}
+			return nil, err
+		}
+		built = append(built, book)
+	}
+	if len(built) == 0 {
+		return nil, ErrExists
+	}
+	return built, nil
+}
+
+// Inspect downloads and parses the article at articleURL like Convert, but
+// stops before any image is fetched. The returned Book only carries the
+// metadata and cannot be written.
+func Inspect(ctx context.Context, articleURL string, opts Options) (*Book, error) {
+	opts.inspectOnly = true
+	return Convert(ctx, articleURL, opts)
+}
+
+// ConvertToFile converts the article at articleURL and writes it to out,
+// which may name a file or a directory (see resolveOutputPath). It returns
+// the path of the written file, or of the existing one together with
+// ErrExists when the article was skipped.
+func ConvertToFile(ctx context.Context, articleURL, out string, opts Options) (string, error) {
+	paths, err := ConvertToFiles(ctx, articleURL, out, []string{opts.Format}, opts)
+	if len(paths) == 0 {
+		return "", err
+	}
+	return paths[0], err
+}
+
+// ConvertToFiles is ConvertToFile for several formats built from one
+// download (see ConvertFormats). out must then be a directory. It returns
+// the paths of the written files, or of the existing ones together with
+// ErrExists when all of them were skipped.
+func ConvertToFiles(ctx context.Context, articleURL, out string, formats []string, opts Options) ([]string, error) {
+	var existing []string
+	opts.checkOutput = func(b *Book) error {
+		var err error
+		b.path, err = resolveOutputPath(out, outputName(b, &opts), b.Ext)
+		if err != nil {
+			return fmt.Errorf("failed to prepare output path: %w", err)
+		}
+		if opts.SkipExisting {
+			if _, err := os.Stat(b.path); err == nil {
+				opts.debugf("skipping %s (exists)", b.path)
+				existing = append(existing, b.path)
+				return ErrExists
+			}
+		}
+		return nil
+	}
+
+	books, err := ConvertFormats(ctx, articleURL, formats, opts)
+	if errors.Is(err, ErrExists) {
+		return existing, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, book := range books {
+			book.Close()
+		}
+	}()
+
+	var paths []string
+	for _, book := range books {
+		if err := book.save(opts.KeepEPUB); err != nil {
+			return paths, err
+		}
+		paths = append(paths, book.path)
+	}
+	return paths, nil
+}
+
+// save writes the book to the path chosen by ConvertToFiles, together with
+// the images of a Markdown book and, when keepEPUB is set, the EPUB a
+// converted book was made from.
+func (b *Book) save(keepEPUB bool) error {
+	kind := strings.ToUpper(strings.TrimPrefix(b.Ext, "."))
+	f, err := os.Create(b.path)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", kind, err)
+	}
+	if _, err := b.WriteTo(f); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write %s: %w", kind, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", kind, err)
+	}
+	if b.Ext == ".md" {
+		if err := b.writeAssets(filepath.Dir(b.path)); err != nil {
+			return fmt.Errorf("failed to write images: %w", err)
+		}
+	}
+	if keepEPUB && b.converter != "" {
+		if err := b.saveEPUB(strings.TrimSuffix(b.path, b.Ext) + ".epub"); err != nil {
+			return fmt.Errorf("failed to keep EPUB: %w", err)
+		}
+	}
+	return nil
+}
+
+// part is one downloaded article; a series book is made of several.
+type part struct {
+	url       *url.URL
+	page      *goquery.Document
+	doc       *goquery.Document
+	title     string
+	author    string
+	published string
+	summary   string
+	lang      string
+	text      string
+	words     int
+}
+
+// parseArticleURL parses the base URL for readability and makes sure it
+// is an article.
+func parseArticleURL(articleURL string, opts *Options) (*url.URL, error) {
+	parsedURL, err := url.Parse(articleURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid URL provided: %w", err)
+	}
+	if err := validateArticleURL(parsedURL, opts.AllowAnyHost); err != nil {
+		return nil, fmt.Errorf("invalid URL provided: %w", err)
+	}
+	return parsedURL, nil
+}
+
+// readPart extracts the article saved in opts.PageFile, which was
+// downloaded from articleURL. There is no API fallback, so the result only
+// depends on the file.
+func readPart(articleURL string, opts *Options) (*part, error) {
+	parsedURL, err := parseArticleURL(articleURL, opts)
+	if err != nil {
+		return nil, err
+	}
+	rawHTML, err := readPageFile(opts.PageFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read page file: %w", err)
+	}
+	opts.debugf("read %s (%d bytes)", opts.PageFile, len(rawHTML))
+	return extractPart(rawHTML, parsedURL, opts.pageDir(), opts)
+}
+
+// fetchPart downloads the article at articleURL and extracts its content
+// and metadata.
+func fetchPart(ctx context.Context, articleURL string, opts *Options) (*part, error) {
+	// 1. Parse the base URL for readability and make sure it is an article
+	parsedURL, err := parseArticleURL(articleURL, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Download the page, or ask the API first when told to
+	if opts.PreferAPI {
+		apiHTML, err := fetchArticleAPI(ctx, opts.Fetcher, parsedURL)
+		if err == nil {
+			opts.debugf("fetched %s from the article API", articleURL)
+			return extractPart(apiHTML, parsedURL, "", opts)
+		}
+		opts.logf("warning: article API failed for %s, scraping the page instead: %v", articleURL, err)
+	}
+	rawHTML, err := opts.Fetcher.FetchURL(ctx, articleURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch URL: %w", err)
+	}
+	opts.debugf("fetched %s (%d bytes)", articleURL, len(rawHTML))
+
+	p, err := extractPart(rawHTML, parsedURL, "", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2a. A page rendered by JavaScript leaves readability next to nothing;
+	// Habr's article API serves the full text.
+	if !opts.NoFallback && len(strings.TrimSpace(p.text)) < minArticleText {
+		apiHTML, err := fetchArticleAPI(ctx, opts.Fetcher, parsedURL)
+		if err != nil {
+			opts.debugf("article API fallback failed: %v", err)
+		} else if fallback, err := extractPart(apiHTML, parsedURL, "", opts); err == nil && len(fallback.text) > len(p.text) {
+			opts.logf("article text of %s looks truncated; using the Habr article API instead", articleURL)
+			return fallback, nil
+		}
+	}
+	// 2b. Without the session cookie, members-only articles are a teaser.
+	if membersOnly(p.page) {
+		return nil, ErrMembersOnly
+	}
+	return p, nil
+}
+
+// extractPart extracts the article content and metadata from the page
+// rawHTML downloaded from parsedURL. localDir is the folder of a page read
+// from disk, whose images are resolved against it; it is empty otherwise.
+func extractPart(rawHTML []byte, parsedURL *url.URL, localDir string, opts *Options) (*part, error) {
+	// The raw page keeps the metadata that readability drops.
+	page, err := goquery.NewDocumentFromReader(bytes.NewReader(rawHTML))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse page HTML: %w", err)
+	}
+
+	// Images saved next to a page file are read from disk.
+	rewritten := 0
+	if localDir != "" {
+		rewritten = localizeImages(page, localDir)
+	}
+	// Live embeds cannot be shown in an e-book; keep a link to each
+	// instead. KaTeX formulas are reduced to TeX or MathML and spoilers
+	// opened for the same reason, before readability mangles them, and
+	// tables lose the wrappers that make readability drop them.
+	rewritten += replaceIframes(page, parsedURL)
+	rewritten += replaceKaTeX(page, opts.Math)
+	rewritten += replaceFormulaImages(page, opts.Math)
+	rewritten += replaceSpoilers(page, opts.Spoilers)
+	rewritten += unwrapTables(page)
+	// Polls are put back below the text once readability is done.
+	polls := extractPolls(page)
+	rewritten += len(polls)
+	if opts.KeepFigures {
+		rewritten += unwrapFigures(page)
+	}
+	// Readability gets the page without Habr's interface blocks.
+	readable := page
+	if clean := stripChrome(page, opts.Strip); clean != nil {
+		readable = clean
+	}
+	if rewritten > 0 || readable != page {
+		modified, err := readable.Html()
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize page HTML: %w", err)
+		}
+		rawHTML = []byte(modified)
+	}
+
+	// 3. Extract the main article using go‑readability, keeping the
+	// language classes of code blocks for the stylesheet.
+	parser := readability.NewParser()
+	if opts.MinContentLength > 0 {
+		parser.CharThresholds = opts.MinContentLength
+	}
+	parser.ClassesToPreserve = append(parser.ClassesToPreserve, "embed", "math", "spoiler", "spoiler-title")
+	parser.ClassesToPreserve = append(parser.ClassesToPreserve, codeClasses(page)...)
+	article, err := parser.Parse(bytes.NewReader(rawHTML), parsedURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse article: %w", err)
+	}
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(article.Content))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse article HTML: %w", err)
+	}
+	stripReadMore(doc)
+	if len(polls) > 0 {
+		doc.Find("body").AppendHtml(pollsHTML(polls))
+	}
+
+	p := &part{url: parsedURL, page: page, doc: doc, title: article.Title, text: article.TextContent}
+	p.words = len(strings.Fields(article.TextContent))
+	if strings.TrimSpace(p.title) == "" {
+		p.title = "Habr Article"
+	}
+	// Readability does not reliably find the author; fall back to a generic one.
+	if p.author = extractAuthor(page); p.author == "" {
+		p.author = "Habr"
+	}
+	p.published = extractPublishedDate(page)
+	p.summary = extractDescription(page)
+	if p.lang = opts.Lang; p.lang == "" {
+		p.lang = detectLanguage(page, parsedURL)
+	}
+	return p, nil
+}
+
+// collectParts downloads the article at articleURL, or reads it from
+// opts.PageFile, followed by the other parts of its series and the linked
+// articles when they are asked for.
+func collectParts(ctx context.Context, articleURL string, opts *Options) ([]*part, error) {
+	var lead *part
+	var err error
+	if opts.PageFile != "" {
+		lead, err = readPart(articleURL, opts)
+	} else {
+		lead, err = fetchPart(ctx, articleURL, opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+	parts := []*part{lead}
+	if opts.Series {
+		parts = collectSeries(ctx, lead, opts)
+		opts.debugf("series has %d part(s)", len(parts))
+	}
+	if len(opts.Anthology) > 0 {
+		parts = collectAnthology(ctx, parts, opts.Anthology, opts)
+	}
+	if opts.Depth > 0 {
+		parts = collectLinked(ctx, parts, opts.Depth, opts)
+	}
+	return parts, nil
+}
+
+// cloneParts copies parts with their own article documents, which the
+// conversion rewrites. The pages stay shared; they are only read.
+func cloneParts(parts []*part) []*part {
+	clones := make([]*part, len(parts))
+	for i, p := range parts {
+		c := *p
+		c.doc = goquery.NewDocumentFromNode(p.doc.Clone().Get(0))
+		clones[i] = &c
+	}
+	return clones
+}
+
+// convert builds book in opts.Format from the downloaded parts.
+func convert(ctx context.Context, book *Book, parts []*part, fontData []byte, fontExt string, opts *Options) error {
+	lead := parts[0]
+
+	// 4. Prepare EPUB; a series shares the metadata of its first part
+	title := lead.title
+	if opts.Title != "" {
+		title = opts.Title
+	}
+	author := bookAuthor(parts)
+	e := epub.NewEpub(title)
+	book.Title = title
+	e.SetAuthor(author)
+	book.Author = author
+	book.ID = articleID(lead.url)
+	e.SetLang(lead.lang)
+	// A series has no summary of its own; the first part's would mislead.
+	var summary string
+	if len(parts) == 1 {
+		summary = lead.summary
+	}
+	if summary != "" {
+		e.SetDescription(summary)
+	}
+	// go-epub starts with a random UUID; a stable one lets readers and
+	// library managers recognize a re-downloaded article.
+	identifier := bookIdentifier(lead.url, len(parts) > 1)
+	if len(opts.Anthology) > 0 {
+		identifier = anthologyIdentifier(parts)
+	}
+	if !opts.RandomIdentifier {
+		e.SetIdentifier(identifier)
+	}
+
+	// Dublin Core fields go-epub cannot set itself.
+	var opfMeta []string
+	// Leave the date unset rather than guessing; today's date would be wrong for archived articles.
+	if lead.published != "" {
+		opfMeta = append(opfMeta, dcElement("date", lead.published))
+		book.Published = lead.published
+	}
+	for _, subject := range extractSubjects(lead.page) {
+		opfMeta = append(opfMeta, dcElement("subject", subject))
+	}
+
+	// Let the caller decide where the book goes before the images are fetched.
+	if opts.checkOutput != nil {
+		if err := opts.checkOutput(book); err != nil {
+			return err
+		}
+	}
+
+	for _, p := range parts {
+		book.Images += p.doc.Find("img").Length()
+		book.Words += p.words
+	}
+	book.Parts = len(parts)
+	book.ReadingTime = readingMinutes(book.Words)
+	if opts.inspectOnly {
+		book.inspected = true
+		return nil
+	}
+
+	// 4a. JSON carries the parsed articles as they are, with the images at
+	// their original URLs
+	if opts.Format == "json" {
+		text, err := jsonBook(parts)
+		if err != nil {
+			return err
+		}
+		book.text = text
+		return nil
+	}
+
+	// Resources are staged here; go-epub reads them only when the book is
+	// written, so the directory lives until the book is closed.
+	tmpDir, err := os.MkdirTemp("", "habrdownloader-")
+	if err != nil {
+		return fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	book.tmpDir = tmpDir
+
+	// 4b. Show the code of gist and CodePen embeds, not just links to them
+	if !opts.NoEmbedCode {
+		for _, p := range parts {
+			if n := inlineEmbedCode(ctx, p.doc, opts); n > 0 {
+				opts.debugf("inlined the code of %d embed(s)", n)
+			}
+		}
+	}
+
+	// 5. Embed images. failedImages records every image that could not be
+	// embedded, with the reason.
+	var failedImages []string
+	imgCounter := 1
+	for _, p := range parts {
+		// Plain text keeps no more of an image than its alt text.
+		if opts.NoImages || opts.Format == "txt" {
+			stripImages(p.doc)
+			if opts.Format == "txt" {
+				continue
+			}
+		} else {
+			if n := wrapCaptions(p.doc); n > 0 {
+				opts.debugf("paired %d image(s) with their captions", n)
+			}
+			failedImages = append(failedImages, embedImages(ctx, p.doc, p.url, e, book.tmpDir, &imgCounter, opts)...)
+		}
+		// Drawings that cannot be rasterized stay inline, so nothing is lost.
+		for _, failure := range handleInlineSVG(p.doc, e, book.tmpDir, &imgCounter, opts) {
+			opts.logf("warning: kept %s inline", failure)
+		}
+	}
+
+	if opts.StrictImages && len(failedImages) > 0 {
+		return fmt.Errorf("failed to embed %d image(s):\n  %s", len(failedImages), strings.Join(failedImages, "\n  "))
+	}
+	for _, failure := range failedImages {
+		opts.logf("warning: skipped image %s", failure)
+	}
+
+	// 5a. Pick a cover: the Open Graph image, else the first article image,
+	// else one drawn with the title, author and date
+	var fb2CoverURI string
+	if !opts.NoCover {
+		text := coverText{title: title, author: author, published: lead.published}
+		switch opts.Format {
+		case "html", "md", "txt":
+		case "fb2":
+			fb2CoverURI = fb2Cover(ctx, lead.page, lead.doc, lead.url, text, opts)
+		default:
+			embedCover(ctx, lead.page, lead.doc, lead.url, e, book.tmpDir, text, opts)
+		}
+	}
+
+	// 5b. Point links between the parts of the book at the parts themselves;
+	// Markdown and plain text have no anchors to point at
+	if len(parts) > 1 && opts.Format != "md" && opts.Format != "txt" {
+		target := func(i int) string { return partFile(i) }
+		if opts.inlineImages() {
+			target = func(i int) string { return "#" + partAnchor(i) }
+		}
+		if n := crossLinkParts(parts, target); n > 0 {
+			opts.debugf("pointed %d link(s) at parts of the book", n)
+		}
+	}
+
+	// 5c. Move external links into a references list
+	var refs references
+	if opts.Footnotes {
+		target := referencesFile
+		if documentFormats[opts.Format] {
+			target = ""
+		}
+		for _, p := range parts {
+			footnoteLinks(p.doc, &refs, target)
+		}
+		opts.debugf("collected %d reference(s)", len(refs.urls))
+	}
+
+	// 5d. Color the code blocks, since readers run no highlighter; the
+	// other document formats have no colors to show
+	if opts.HighlightStyle != "" && (opts.Format == "html" || !documentFormats[opts.Format]) {
+		for _, p := range parts {
+			opts.debugf("highlighted %d code block(s)", highlightCode(p.doc, opts.HighlightStyle))
+		}
+	}
+
+	// 6. Serialize modified HTML
+	var rendered []renderedPart
+	for _, p := range parts {
+		r, err := renderPart(ctx, p, opts)
+		if err != nil {
+			return err
+		}
+		rendered = append(rendered, r)
+	}
+
+	var appendix string
+	if opts.SeriesLinks && len(parts) == 1 {
+		if links := extractSeriesLinks(lead.page, lead.url); len(links) > 0 {
+			appendix = seriesLinksHTML(links)
+		}
+	}
+
+	// 6a. Markdown is converted from the HTML; its images are in the assets
+	// folder staged in tmpDir
+	if opts.Format == "md" {
+		text, err := markdownBook(title, lead, rendered, appendix, &refs)
+		if err != nil {
+			return err
+		}
+		book.text = text
+		return nil
+	}
+
+	// 6b. Plain text drops the markup altogether
+	if opts.Format == "txt" {
+		text, err := textBook(title, rendered, appendix, &refs)
+		if err != nil {
+			return err
+		}
+		book.text = text
+		return nil
+	}
+
+	// 6c. FB2 maps the HTML onto its own elements and has no stylesheet
+	if opts.Format == "fb2" {
+		if opts.CSSFile != "" || opts.FontFile != "" {
+			opts.logf("warning: FB2 books have no stylesheet or fonts; ignoring them")
+		}
+		text, err := fb2Book(title, parts, rendered, appendix, &refs, opts)
+		if err != nil {
+			return err
+		}
+		id := identifier
+		if opts.RandomIdentifier {
+			if u, err := uuid.NewV4(); err == nil {
+				id = "urn:uuid:" + u.String()
+			}
+		}
+		book.text = text.document(fb2Meta{
+			title:     title,
+			author:    author,
+			lang:      lead.lang,
+			published: lead.published,
+			summary:   summary,
+			subjects:  extractSubjects(lead.page),
+			source:    lead.url.String(),
+			id:        id,
+			cover:     fb2CoverURI,
+		})
+		return nil
+	}
+
+	css := defaultCSS
+	if opts.CSSFile != "" {
+		custom, err := os.ReadFile(opts.CSSFile)
+		if err != nil {
+			return fmt.Errorf("failed to read stylesheet: %w", err)
+		}
+		css = string(custom)
+	}
+
+	// Kobo readers get their sentence spans in every section, and EPUB 3
+	// books their semantics from the epub:type of each.
+	section := func(body, epubType string) string {
+		if opts.Kepub {
+			body = kepubHTML(body)
+		}
+		if opts.EPUB3 {
+			return epub3Section(body, epubType)
+		}
+		return sectionHTML(body)
+	}
+
+	// 6d. Drop the rules of the stylesheet that nothing in the book uses,
+	// matched against the sections as they are written
+	var frontPage string
+	if opts.Format != "html" && !opts.NoFrontPage {
+		frontPage = frontPageHTML(title, parts, book.Words, time.Now())
+	}
+	if opts.PruneCSS {
+		wrap := section
+		if opts.Format == "html" {
+			wrap = func(body, epubType string) string { return body }
+		}
+		markup := []string{wrap(frontPage, "frontmatter"), wrap(appendix, "backmatter appendix")}
+		for i, r := range rendered {
+			if opts.Format == "html" && len(rendered) > 1 {
+				markup = append(markup, `<h1 id="`+partAnchor(i)+`"></h1>`)
+			}
+			markup = append(markup, wrap(r.body+r.footer, "bodymatter chapter"), wrap(r.comments, "backmatter appendix"))
+		}
+		if len(refs.urls) > 0 {
+			markup = append(markup, wrap(referencesHTML(&refs), "backmatter endnotes"))
+		}
+		pruned := pruneCSS(css, strings.Join(markup, ""))
+		opts.debugf("pruned the stylesheet from %d to %d bytes", len(css), len(pruned))
+		css = pruned
+	}
+
+	if opts.Format == "html" {
+		if fontData != nil {
+			css = fontCSS(opts.FontFile, dataURI(fontData, fontExt)) + css
+		}
+		var body strings.Builder
+		for i, r := range rendered {
+			if len(rendered) > 1 {
+				body.WriteString(`<h1 id="` + partAnchor(i) + `">` + html.EscapeString(r.title) + "</h1>")
+			}
+			body.WriteString(r.body + r.footer + r.comments)
+		}
+		if len(refs.urls) > 0 {
+			body.WriteString(referencesHTML(&refs))
+		}
+		book.text = standaloneHTML(title, lead.lang, css, body.String()+appendix)
+		return nil
+	}
+
+	// 7. Add content as chapters, one or more per part
+	if fontData != nil {
+		name := fontFileName(opts.FontFile, fontExt)
+		fontTmp := filepath.Join(book.tmpDir, name)
+		if err := os.WriteFile(fontTmp, fontData, 0o600); err != nil {
+			return fmt.Errorf("failed to stage font: %w", err)
+		}
+		fontPath, err := e.AddFont(fontTmp, name)
+		if err != nil {
+			return fmt.Errorf("failed to add font to EPUB: %w", err)
+		}
+		css = fontCSS(opts.FontFile, fontPath) + css
+	}
+	cssTmp := filepath.Join(book.tmpDir, "style.css")
+	if err := os.WriteFile(cssTmp, []byte(css), 0o600); err != nil {
+		return fmt.Errorf("failed to stage stylesheet: %w", err)
+	}
+	cssPath, err := e.AddCSS(cssTmp, "style.css")
+	if err != nil {
+		return fmt.Errorf("failed to add stylesheet to EPUB: %w", err)
+	}
+
+	var landmarks []landmark
+	if !opts.NoFrontPage {
+		front := section(frontPage, "frontmatter")
+		if _, err := e.AddSection(front, "About this book", "about.xhtml", cssPath); err != nil {
+			return fmt.Errorf("failed to add front page to EPUB: %w", err)
+		}
+	}
+	for i, r := range rendered {
+		chapterTitle := r.title
+		if strings.TrimSpace(chapterTitle) == "" {
+			chapterTitle = "Article"
+		}
+		chapters := []chapter{{title: chapterTitle, body: r.body}}
+		if opts.SplitHeadings {
+			if split := splitByHeading(parts[i].doc, chapterTitle); len(split) > 1 {
+				chapters = split
+			}
+		}
+		chapters[len(chapters)-1].body += r.footer
+		// In a series each part is a top-level entry of the table of
+		// contents, with its headings nested below it. go-epub nests one
+		// level only, so a single article nests its <h3> chapters below
+		// their <h2> instead.
+		var parent, top string
+		for j, ch := range chapters {
+			if len(rendered) > 1 && j == 0 {
+				ch.title = chapterTitle
+			}
+			var err error
+			if parent != "" {
+				_, err = e.AddSubSection(parent, section(ch.body, "bodymatter chapter"), ch.title, "", cssPath)
+			} else if ch.sub && top != "" {
+				_, err = e.AddSubSection(top, section(ch.body, "bodymatter subchapter"), ch.title, "", cssPath)
+			} else {
+				// Parts get fixed file names for the links between them.
+				var filename string
+				if len(rendered) > 1 {
+					filename = partFile(i)
+				}
+				filename, err = e.AddSection(section(ch.body, "bodymatter chapter"), ch.title, filename, cssPath)
+				if len(rendered) > 1 {
+					parent = filename
+				}
+				top = filename
+				if err == nil && len(landmarks) == 0 {
+					landmarks = append(landmarks, landmark{"bodymatter", filename, "Start of content"})
+				}
+			}
+			if err != nil {
+				return fmt.Errorf("failed to add section to EPUB: %w", err)
+			}
+		}
+
+		if r.comments != "" {
+			commentsTitle := "Comments"
+			if len(rendered) > 1 {
+				commentsTitle = "Comments: " + chapterTitle
+			}
+			if _, err := e.AddSection(section(r.comments, "backmatter appendix"), commentsTitle, "", cssPath); err != nil {
+				return fmt.Errorf("failed to add comments section to EPUB: %w", err)
+			}
+		}
+	}
+
+	// 7a. Append links to the other parts of the series
+	if appendix != "" {
+		if _, err := e.AddSection(section(appendix, "backmatter appendix"), "Other parts in this series", "", cssPath); err != nil {
+			return fmt.Errorf("failed to add series section to EPUB: %w", err)
+		}
+	}
+
+	// 7b. List the URLs the footnotes point to
+	if len(refs.urls) > 0 {
+		if _, err := e.AddSection(section(referencesHTML(&refs), "backmatter endnotes"), "References", referencesFile, cssPath); err != nil {
+			return fmt.Errorf("failed to add references section to EPUB: %w", err)
+		}
+		landmarks = append(landmarks, landmark{"endnotes", referencesFile, "References"})
+	}
+
+	book.epub = e
+	book.opfMeta = opfMeta
+	if opts.EPUB3 {
+		book.landmarks = landmarks
+	}
+	return nil
+}
+
+// renderedPart holds the serialized HTML of one part.
+type renderedPart struct {
+	title    string
+	body     string
+	footer   string
+	comments string
+}
+
+// renderPart serializes the article body of p, its attribution footer and,
+// when requested, its comments.
+func renderPart(ctx context.Context, p *part, opts *Options) (renderedPart, error) {
+	r := renderedPart{title: p.title}
+	if !opts.NoReadingTime {
+		p.doc.Find("body").PrependHtml(readingTimeHTML(p.words))
+	}
+	if bodySel := p.doc.Find("body"); bodySel.Length() > 0 {
+		html, err := bodySel.Html()
+		if err != nil {
+			return r, fmt.Errorf("failed to serialize body HTML: %w", err)
+		}
+		r.body = html
+	} else {
+		// Fallback: full document HTML
+		html, err := p.doc.Html()
+		if err != nil {
+			return r, fmt.Errorf("failed to serialize HTML: %w", err)
+		}
+		r.body = html
+	}
+
+	if !opts.NoAttribution {
+		r.footer = attributionHTML(p.url.String(), p.author, time.Now())
+	}
+
+	if opts.Comments {
+		// Comments are optional; a failure should not cost the article.
+		c, err := fetchComments(ctx, opts, p.url)
+		if err != nil {
+			opts.logf("warning: failed to fetch comments: %v", err)
+		} else {
+			if opts.CommentsMinRating != nil {
+				total := len(c.Comments)
+				opts.debugf("kept %d of %d comment(s)", filterComments(c, *opts.CommentsMinRating), total)
+			}
+			if len(c.Threads) > 0 {
+				r.comments = commentsHTML(c)
+			}
+		}
+	}
+	return r, nil
+}
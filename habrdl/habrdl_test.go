@@ -0,0 +1,69 @@
+package habrdl
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// serveArticle serves the fixture file as the article page at
+// /ru/articles/<id>/ and returns the article URL. Everything else,
+// including the API, answers 404.
+func serveArticle(t *testing.T, id, fixture string) string {
+	t.Helper()
+	page, err := os.ReadFile(fixture)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ru/articles/"+id+"/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(page)
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv.URL + "/ru/articles/" + id + "/"
+}
+
+// convertFixture converts the article at articleURL to format offline.
+func convertFixture(t *testing.T, articleURL, format string) *Book {
+	t.Helper()
+	opts := Options{
+		Fetcher:      NewFetcher(nil),
+		AllowAnyHost: true,
+		Format:       format,
+		Logf:         t.Logf,
+	}
+	opts.Fetcher.Retries = 0
+	book, err := Convert(context.Background(), articleURL, opts)
+	if err != nil {
+		t.Fatalf("Convert(%s, %s) failed: %v", articleURL, format, err)
+	}
+	t.Cleanup(func() { book.Close() })
+	return book
+}
+
+func TestMembersOnlyTeaser(t *testing.T) {
+	articleURL := serveArticle(t, "101", "testdata/members_only.html")
+	opts := Options{Fetcher: NewFetcher(nil), AllowAnyHost: true, Logf: t.Logf}
+	opts.Fetcher.Retries = 0
+	_, err := Convert(context.Background(), articleURL, opts)
+	if !errors.Is(err, ErrMembersOnly) {
+		t.Fatalf("Convert = %v, want ErrMembersOnly", err)
+	}
+}
+
+func TestDeletedArticle(t *testing.T) {
+	articleURL := serveArticle(t, "102", "testdata/members_only.html")
+	articleURL = strings.Replace(articleURL, "/102/", "/103/", 1)
+	opts := Options{Fetcher: NewFetcher(nil), AllowAnyHost: true, Logf: t.Logf}
+	opts.Fetcher.Retries = 0
+	_, err := Convert(context.Background(), articleURL, opts)
+	if err == nil || !strings.Contains(err.Error(), "article not found, it may have been deleted (HTTP 404)") {
+		t.Errorf("Convert = %v, want the deleted article message", err)
+	}
+}
@@ -0,0 +1,95 @@
+package habrdl
+
+import (
+	"html"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+)
+
+// HighlightStyleExists reports whether name is a highlighting style that
+// Options.HighlightStyle accepts, such as "github" or "monokai".
+func HighlightStyleExists(name string) bool {
+	_, ok := styles.Registry[name]
+	return ok
+}
+
+// highlightCode colors the code blocks of doc whose language is named by
+// a class (e.g. "language-go" or Habr's bare "go") with the given style.
+// Readers run no highlighter of their own, so every token gets inline
+// styles. Blocks of unknown languages and formulas are left alone. It
+// returns the number of highlighted blocks.
+func highlightCode(doc *goquery.Document, styleName string) int {
+	style := styles.Get(styleName)
+	background := style.Get(chroma.Background)
+	var blockCSS []string
+	if background.Colour.IsSet() {
+		blockCSS = append(blockCSS, "color:"+background.Colour.String())
+	}
+	if background.Background.IsSet() {
+		blockCSS = append(blockCSS, "background:"+background.Background.String())
+	}
+	highlighted := 0
+	doc.Find("pre").Not(".math").Each(func(i int, pre *goquery.Selection) {
+		code := pre.ChildrenFiltered("code")
+		target := code
+		if code.Length() != 1 || pre.Children().Length() != 1 {
+			target = pre
+		}
+		lexer := codeLexer(pre.AttrOr("class", "") + " " + code.AttrOr("class", ""))
+		if lexer == nil {
+			return
+		}
+		tokens, err := chroma.Coalesce(lexer).Tokenise(nil, target.Text())
+		if err != nil {
+			return
+		}
+		var buf strings.Builder
+		for _, token := range tokens.Tokens() {
+			text := html.EscapeString(token.Value)
+			if css := tokenCSS(style.Get(token.Type), background); css != "" {
+				text = `<span style="` + css + `">` + text + "</span>"
+			}
+			buf.WriteString(text)
+		}
+		target.SetHtml(buf.String())
+		if len(blockCSS) > 0 {
+			pre.SetAttr("style", strings.Join(blockCSS, ";"))
+		}
+		highlighted++
+	})
+	return highlighted
+}
+
+// codeLexer returns the lexer for the first class that names a language.
+func codeLexer(classes string) chroma.Lexer {
+	for _, class := range strings.Fields(classes) {
+		name := strings.TrimPrefix(strings.TrimPrefix(class, "language-"), "lang-")
+		if lexer := lexers.Get(name); lexer != nil && lexer != lexers.Fallback {
+			return lexer
+		}
+	}
+	return nil
+}
+
+// tokenCSS renders the inline style of a token, leaving out the colors it
+// shares with base.
+func tokenCSS(entry, base chroma.StyleEntry) string {
+	var rules []string
+	if entry.Colour.IsSet() && entry.Colour != base.Colour {
+		rules = append(rules, "color:"+entry.Colour.String())
+	}
+	if entry.Bold == chroma.Yes {
+		rules = append(rules, "font-weight:bold")
+	}
+	if entry.Italic == chroma.Yes {
+		rules = append(rules, "font-style:italic")
+	}
+	if entry.Underline == chroma.Yes {
+		rules = append(rules, "text-decoration:underline")
+	}
+	return strings.Join(rules, ";")
+}
@@ -0,0 +1,391 @@
+package habrdl
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"mime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// attributionHTML renders the footer naming the article's source, its
+// author (if known) and when it was downloaded.
+func attributionHTML(source, author string, downloaded time.Time) string {
+	var buf bytes.Buffer
+	buf.WriteString(`<hr/><div class="attribution"><p>Source: <a href="`)
+	buf.WriteString(html.EscapeString(source))
+	buf.WriteString(`">`)
+	buf.WriteString(html.EscapeString(source))
+	buf.WriteString("</a></p>")
+	if author != "" {
+		buf.WriteString("<p>Author: " + html.EscapeString(author) + "</p>")
+	}
+	buf.WriteString("<p>Downloaded: " + downloaded.Format("2006-01-02") + "</p></div>")
+	return buf.String()
+}
+
+// frontPageHTML renders the first section of the book, which records
+// where it came from: the source URLs, author, publication date, hubs,
+// tags and rating of the lead part, the reading time of the whole book
+// and when it was downloaded.
+func frontPageHTML(title string, parts []*part, words int, downloaded time.Time) string {
+	lead := parts[0]
+	var buf bytes.Buffer
+	buf.WriteString(`<div class="front-page"><h1>` + html.EscapeString(title) + "</h1><dl>")
+	field := func(name, value string) {
+		if value != "" {
+			buf.WriteString("<dt>" + name + "</dt><dd>" + value + "</dd>")
+		}
+	}
+	var sources []string
+	for _, p := range parts {
+		u := html.EscapeString(p.url.String())
+		sources = append(sources, `<a href="`+u+`">`+u+"</a>")
+	}
+	if len(sources) > 1 {
+		field("Sources", strings.Join(sources, "<br/>"))
+	} else {
+		field("Source", sources[0])
+	}
+	if author := bookAuthor(parts); strings.Contains(author, ", ") {
+		field("Authors", html.EscapeString(author))
+	} else {
+		field("Author", html.EscapeString(author))
+	}
+	if t, err := time.Parse(time.RFC3339, lead.published); err == nil {
+		field("Published", t.Format("2006-01-02"))
+	}
+	field("Hubs", html.EscapeString(strings.Join(extractNames(lead.page, hubSelector), ", ")))
+	field("Tags", html.EscapeString(strings.Join(extractNames(lead.page, tagSelector), ", ")))
+	if rating, ok := extractRating(lead.page); ok {
+		field("Rating", fmt.Sprintf("%+d", rating))
+	}
+	field("Reading time", fmt.Sprintf("~%d min · %s words", readingMinutes(words), groupThousands(words)))
+	field("Downloaded", downloaded.Format("2006-01-02"))
+	buf.WriteString("</dl></div>")
+	return buf.String()
+}
+
+// wordsPerMinute is the reading speed the reading time is estimated with.
+const wordsPerMinute = 200
+
+// readingMinutes estimates how many minutes reading words words takes,
+// rounding up to at least one minute.
+func readingMinutes(words int) int {
+	if words <= 0 {
+		return 0
+	}
+	return (words + wordsPerMinute - 1) / wordsPerMinute
+}
+
+// readingTimeHTML renders the "~12 min read · 2,400 words" line shown
+// under the title.
+func readingTimeHTML(words int) string {
+	return fmt.Sprintf(`<p class="reading-time"><em>~%d min read · %s words</em></p>`, readingMinutes(words), groupThousands(words))
+}
+
+// groupThousands formats n with commas between groups of three digits.
+func groupThousands(n int) string {
+	s := strconv.Itoa(n)
+	for i := len(s) - 3; i > 0; i -= 3 {
+		s = s[:i] + "," + s[i:]
+	}
+	return s
+}
+
+// sectionHTML wraps body into the minimal HTML document used for EPUB sections.
+func sectionHTML(body string) string {
+	return "<html><head><meta charset=\"utf-8\"></head><body>" + body + "</body></html>"
+}
+
+// standaloneHTML wraps body into a complete HTML page titled title, with
+// css embedded in the head.
+func standaloneHTML(title, lang, css, body string) string {
+	return "<!DOCTYPE html>\n<html lang=\"" + html.EscapeString(lang) + "\"><head><meta charset=\"utf-8\"><title>" + html.EscapeString(title) +
+		"</title><style>\n" + css + "</style></head><body><h1>" + html.EscapeString(title) + "</h1>" + body + "</body></html>\n"
+}
+
+// defaultCSS is the stylesheet linked from every section unless Options.CSSFile is set.
+const defaultCSS = `pre {
+  background: #f6f8fa;
+  border: 1px solid #e1e4e8;
+  border-radius: 3px;
+  padding: 0.6em;
+  overflow-x: auto;
+  white-space: pre-wrap;
+  word-wrap: break-word;
+}
+code {
+  font-family: "DejaVu Sans Mono", Menlo, Consolas, monospace;
+  font-size: 0.9em;
+}
+pre code {
+  background: none;
+  padding: 0;
+}
+:not(pre) > code {
+  background: #f6f8fa;
+  padding: 0.1em 0.3em;
+}
+blockquote {
+  margin: 1em 0 1em 1em;
+  padding-left: 0.8em;
+  border-left: 3px solid #c0c4c8;
+  color: #444;
+}
+img {
+  max-width: 100%;
+  height: auto;
+}
+.reading-time {
+  font-size: 0.85em;
+  color: #555;
+}
+.attribution {
+  font-size: 0.85em;
+  color: #555;
+}
+pre.math {
+  background: none;
+  border: none;
+  text-align: center;
+}
+table {
+  border-collapse: collapse;
+  margin: 1em 0;
+  max-width: 100%;
+}
+th, td {
+  border: 1px solid #c0c4c8;
+  padding: 0.3em 0.6em;
+  vertical-align: top;
+}
+th {
+  background: #f6f8fa;
+  font-weight: bold;
+}
+.embed {
+  margin: 1em 0;
+  padding: 0.5em;
+  border: 1px dashed #c0c4c8;
+  text-align: center;
+}
+.embed img {
+  max-width: 100%;
+}
+figure {
+  margin: 1em 0;
+  text-align: center;
+}
+figure img {
+  max-width: 100%;
+}
+figcaption {
+  font-size: 0.9em;
+  font-style: italic;
+  color: #555;
+}
+.embed pre {
+  text-align: left;
+}
+.embed-file {
+  margin: 0.5em 0 0.2em;
+  font-size: 0.85em;
+  font-weight: bold;
+  text-align: left;
+}
+.footnote-ref {
+  font-size: 0.75em;
+  line-height: 0;
+}
+ol.references {
+  word-wrap: break-word;
+}
+.front-page dt {
+  font-weight: bold;
+  margin-top: 0.5em;
+}
+.front-page dd {
+  margin-left: 1em;
+  word-wrap: break-word;
+}
+.spoiler {
+  margin: 1em 0;
+  padding: 0.3em 0.8em;
+  border: 1px solid #e1e4e8;
+  border-left: 3px solid #c0c4c8;
+}
+.spoiler-title, .spoiler summary {
+  margin: 0.3em 0;
+  font-weight: bold;
+}
+.poll {
+  margin: 1em 0;
+}
+.poll-total {
+  font-size: 0.85em;
+  color: #555;
+}
+.comment {
+  margin: 0.5em 0 0.5em 1em;
+  padding-left: 0.5em;
+  border-left: 2px solid #e1e4e8;
+}
+.comment-meta {
+  margin: 0;
+  font-size: 0.85em;
+  color: #555;
+}
+`
+
+// codeClasses returns the classes of the page's code blocks (e.g.
+// "language-go" or Habr's bare "go"), so readability keeps them.
+func codeClasses(page *goquery.Document) []string {
+	seen := make(map[string]bool)
+	var classes []string
+	page.Find("pre, pre code").Each(func(i int, s *goquery.Selection) {
+		for _, class := range strings.Fields(s.AttrOr("class", "")) {
+			if !seen[class] {
+				seen[class] = true
+				classes = append(classes, class)
+			}
+		}
+	})
+	return classes
+}
+
+// dataURI encodes data as a base64 data: URI, deriving the media type from ext.
+func dataURI(data []byte, ext string) string {
+	mediaType := mime.TypeByExtension(ext)
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	return "data:" + mediaType + ";base64," + base64.StdEncoding.EncodeToString(data)
+}
+
+// unwrapTables removes the divs that wrap tables on their own, such as
+// Habr's horizontally scrolling containers. Readability judges such a
+// div by its short text and drops it together with the table. It returns
+// the number of removed wrappers.
+func unwrapTables(page *goquery.Document) int {
+	return unwrapLone(page, "table")
+}
+
+// unwrapFigures does the same for figures, whose wrappers readability
+// drops when the caption is short.
+func unwrapFigures(page *goquery.Document) int {
+	return unwrapLone(page, "figure")
+}
+
+// unwrapLone removes every div whose only content is an element matched
+// by selector and returns the number of removed divs.
+func unwrapLone(page *goquery.Document, selector string) int {
+	unwrapped := 0
+	page.Find(selector).Each(func(i int, s *goquery.Selection) {
+		for parent := s.Parent(); parent.Is("div") && parent.Children().Length() == 1; parent = s.Parent() {
+			// Text outside the element stays wrapped.
+			if strings.TrimSpace(parent.Text()) != strings.TrimSpace(s.Text()) {
+				break
+			}
+			s.Unwrap()
+			unwrapped++
+		}
+	})
+	return unwrapped
+}
+
+// chapter is one EPUB section of an article.
+type chapter struct {
+	title string
+	body  string
+	// sub marks an <h3> chapter that belongs to the <h2> chapter before it.
+	sub bool
+}
+
+// splitByHeading splits the article at its <h2> and <h3> elements, one
+// chapter per heading. Content before the first heading becomes an intro
+// chapter named introTitle. Content outside the headings' parent, such as
+// the reading time line and the polls added around the text, goes to the
+// first and the last chapter. Headings that do not share a parent cannot
+// be split cleanly, so the whole article is then returned as a single
+// chapter.
+func splitByHeading(doc *goquery.Document, introTitle string) []chapter {
+	headings := doc.Find("h2, h3")
+	if headings.Length() == 0 {
+		return nil
+	}
+	// Without any <h2> the <h3> headings are the top level.
+	nested := doc.Find("h2").Length() > 0
+	parent := headings.First().Parent()
+	for i := 1; i < headings.Length(); i++ {
+		if headings.Eq(i).Parent().Get(0) != parent.Get(0) {
+			return nil
+		}
+	}
+
+	chapters := []chapter{{title: introTitle}}
+	var body strings.Builder
+	flush := func() {
+		chapters[len(chapters)-1].body = body.String()
+		body.Reset()
+	}
+	parent.Contents().Each(func(i int, s *goquery.Selection) {
+		if name := goquery.NodeName(s); name == "h2" || name == "h3" {
+			flush()
+			title := strings.TrimSpace(s.Text())
+			if title == "" {
+				title = introTitle
+			}
+			chapters = append(chapters, chapter{title: title, sub: nested && name == "h3"})
+		}
+		if h, err := goquery.OuterHtml(s); err == nil {
+			body.WriteString(h)
+		}
+	})
+	flush()
+	before, after := outsideContent(parent)
+	chapters[0].body = before + chapters[0].body
+	chapters[len(chapters)-1].body += after
+
+	// Drop an intro that holds nothing but whitespace.
+	if strings.TrimSpace(chapters[0].body) == "" {
+		chapters = chapters[1:]
+	}
+	// An <h3> before the first <h2> has no chapter to belong to.
+	for i := 0; i < len(chapters) && chapters[i].sub; i++ {
+		chapters[i].sub = false
+	}
+	return chapters
+}
+
+// outsideContent returns the HTML of what <body> holds around s, before
+// and after it.
+func outsideContent(s *goquery.Selection) (before, after string) {
+	for node := s; node.Length() > 0 && goquery.NodeName(node) != "body"; node = node.Parent() {
+		var prev, next strings.Builder
+		seen := false
+		node.Parent().Contents().Each(func(i int, c *goquery.Selection) {
+			if c.Get(0) == node.Get(0) {
+				seen = true
+				return
+			}
+			h, err := goquery.OuterHtml(c)
+			if err != nil {
+				return
+			}
+			if seen {
+				next.WriteString(h)
+			} else {
+				prev.WriteString(h)
+			}
+		})
+		before = prev.String() + before
+		after += next.String()
+	}
+	return before, after
+}
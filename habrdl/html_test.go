@@ -0,0 +1,73 @@
+package habrdl
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+)
+
+// epubSections returns the XHTML documents of the EPUB book b by name.
+func epubSections(t *testing.T, b *Book) map[string]string {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := b.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := make(map[string]string)
+	for _, f := range zr.File {
+		if !strings.HasSuffix(f.Name, ".xhtml") {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sections[f.Name] = string(data)
+	}
+	return sections
+}
+
+// The reading time line and the polls sit outside the wrapper that holds
+// the headings, and must survive the split.
+func TestSplitHeadingsKeepsOutsideContent(t *testing.T) {
+	articleURL := serveArticle(t, "100", "testdata/split_article.html")
+	opts := Options{Fetcher: NewFetcher(nil), AllowAnyHost: true, SplitHeadings: true, NoFrontPage: true, Logf: t.Logf}
+	opts.Fetcher.Retries = 0
+	book, err := Convert(context.Background(), articleURL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer book.Close()
+
+	sections := epubSections(t, book)
+	var intro, last string
+	for _, s := range sections {
+		// The table of contents names the headings without <h2> tags.
+		switch {
+		case strings.Contains(s, "<h2>Второй раздел</h2>"):
+			last = s
+		case strings.Contains(s, "Длинные статьи") && !strings.Contains(s, "<h2>"):
+			intro = s
+		}
+	}
+	if !strings.Contains(intro, `class="reading-time"`) {
+		t.Errorf("the intro chapter lacks the reading time line:\n%s", intro)
+	}
+	for _, want := range []string{"Как вы читаете длинные статьи?", "По разделам"} {
+		if !strings.Contains(last, want) {
+			t.Errorf("the last chapter lacks the poll text %q:\n%s", want, last)
+		}
+	}
+}
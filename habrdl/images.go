@@ -0,0 +1,636 @@
+package habrdl
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/bmaupin/go-epub"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// imageJob is a unique image URL scheduled for download, together with
+// every <img> element that refers to it.
+type imageJob struct {
+	sels []*goquery.Selection
+	url  *url.URL
+	data []byte
+	ext  string
+	err  error
+}
+
+// placeholderPattern matches the tiny stand-in images Habr puts into src
+// while the real image is lazy-loaded.
+var placeholderPattern = regexp.MustCompile(`(?i)^data:|image-loader|placeholder|blank\.gif|1x1\.`)
+
+// bestSrcsetCandidate returns the URL with the largest width or density
+// descriptor from a srcset attribute value. Inline data: candidates, which
+// are placeholders, are skipped.
+func bestSrcsetCandidate(srcset string) string {
+	best, bestScore := "", -1.0
+	for _, candidate := range strings.Split(srcset, ",") {
+		fields := strings.Fields(candidate)
+		if len(fields) == 0 || strings.HasPrefix(strings.ToLower(fields[0]), "data:") {
+			continue
+		}
+		score := 1.0
+		if len(fields) > 1 {
+			d := fields[1]
+			if v, err := strconv.ParseFloat(strings.TrimRight(d, "wx"), 64); err == nil {
+				score = v
+			}
+		}
+		if score > bestScore {
+			best, bestScore = fields[0], score
+		}
+	}
+	return best
+}
+
+// lazyImageAttrs are the attributes that carry the real image while src
+// holds a placeholder, best first. data-blurred-src is Habr's blurred
+// preview and the last resort.
+var lazyImageAttrs = []string{"data-src", "data-original", "data-full-src", "data-blurred-src"}
+
+// sourceTypes are the MIME types of <picture> sources that can be embedded.
+// Sources of other types, such as AVIF, are skipped for the fallback.
+var sourceTypes = map[string]bool{
+	"image/jpeg":    true,
+	"image/png":     true,
+	"image/gif":     true,
+	"image/webp":    true,
+	"image/svg+xml": true,
+}
+
+// imageSource picks the URL to download for an <img>: the best srcset
+// candidate of the image or of the <source> elements of its <picture>
+// whose type can be embedded, then data-src and the other lazy-loading attributes, which hold the full
+// image while src often holds a reduced one, then src unless it is a known
+// lazy-loading placeholder.
+func imageSource(s *goquery.Selection) string {
+	srcsets := []string{s.AttrOr("srcset", ""), s.AttrOr("data-srcset", "")}
+	if picture := s.Parent().Filter("picture"); picture.Length() > 0 {
+		picture.ChildrenFiltered("source").Each(func(i int, source *goquery.Selection) {
+			if t := strings.ToLower(strings.TrimSpace(source.AttrOr("type", ""))); t != "" && !sourceTypes[t] {
+				return
+			}
+			srcsets = append(srcsets, source.AttrOr("srcset", ""), source.AttrOr("data-srcset", ""))
+		})
+	}
+	if best := bestSrcsetCandidate(strings.Join(srcsets, ",")); best != "" {
+		return best
+	}
+	src := strings.TrimSpace(s.AttrOr("src", ""))
+	for _, attr := range lazyImageAttrs {
+		if attr == "data-blurred-src" && src != "" && !placeholderPattern.MatchString(src) {
+			return src
+		}
+		if v := strings.TrimSpace(s.AttrOr(attr, "")); v != "" {
+			return v
+		}
+	}
+	return src
+}
+
+// setImageSource points an <img> at src and drops the lazy-loading
+// attributes that would otherwise override it. An enclosing <picture> is
+// unwrapped, as its <source> elements would too.
+func setImageSource(s *goquery.Selection, src string) {
+	s.SetAttr("src", src)
+	for _, attr := range append([]string{"srcset", "data-srcset"}, lazyImageAttrs...) {
+		s.RemoveAttr(attr)
+	}
+	if picture := s.Parent().Filter("picture"); picture.Length() > 0 {
+		picture.ChildrenFiltered("source").Remove()
+		s.Unwrap()
+	}
+}
+
+// fetchImages downloads the images of all jobs using up to
+// opts.Concurrency concurrent requests; file:// images of a page loaded
+// from disk are read directly. Results are stored on the jobs themselves,
+// so callers can process them in their original order afterwards.
+// opts.Progress, if set, is called after every finished download, never
+// concurrently.
+func fetchImages(ctx context.Context, jobs []*imageJob, opts *Options) {
+	workers, progress, localDir := opts.Concurrency, opts.Progress, opts.pageDir()
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan *imageJob)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	done := 0
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				if job.url.Scheme == "file" {
+					job.data, job.ext, job.err = readLocalImage(job.url, localDir)
+				} else {
+					job.data, job.ext, job.err = opts.fetchBinary(ctx, job.url.String())
+				}
+				if progress != nil {
+					mu.Lock()
+					done++
+					progress(done, len(jobs))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// isAnimatedWebP reports whether data is an extended-format WebP with the
+// animation flag set in its VP8X chunk.
+func isAnimatedWebP(data []byte) bool {
+	if len(data) < 21 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return false
+	}
+	return string(data[12:16]) == "VP8X" && data[20]&0x02 != 0
+}
+
+// webpTarget picks the format a still WebP image is best transcoded to:
+// PNG for lossless images and images with transparency, JPEG for lossy
+// photos, which would grow several times as PNG.
+func webpTarget(data []byte) string {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return "png"
+	}
+	alpha := false
+	for off := 12; off+8 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[off+4 : off+8]))
+		switch string(data[off : off+4]) {
+		case "ALPH":
+			alpha = true
+		case "VP8 ":
+			if !alpha {
+				return "jpg"
+			}
+			return "png"
+		case "VP8L":
+			return "png"
+		}
+		off += 8 + size + size&1
+	}
+	return "png"
+}
+
+// transcodeWebP re-encodes a still WebP image as PNG or JPEG, depending on
+// format ("png", "jpg", or "auto" for the one webpTarget picks), and
+// returns the new bytes and file extension.
+// JPEGs are written at quality, or at defaultWebPJPEGQuality when it is 0.
+func transcodeWebP(data []byte, format string, quality int) ([]byte, string, error) {
+	img, err := webp.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if format == "auto" {
+		format = webpTarget(data)
+	}
+	var buf bytes.Buffer
+	switch format {
+	case "png":
+		err = png.Encode(&buf, img)
+		return buf.Bytes(), ".png", err
+	case "jpg":
+		if quality <= 0 {
+			quality = defaultWebPJPEGQuality
+		}
+		err = jpeg.Encode(&buf, flattenAlpha(img), &jpeg.Options{Quality: quality})
+		return buf.Bytes(), ".jpg", err
+	default:
+		return nil, "", fmt.Errorf("unsupported WebP target format %q", format)
+	}
+}
+
+// Quality of JPEGs that are re-encoded without an explicit -jpeg-quality.
+const (
+	defaultJPEGQuality     = 85
+	defaultWebPJPEGQuality = 90
+)
+
+// shrinkImage shrinks JPEG and PNG images wider than maxWidth, keeping
+// the aspect ratio, and re-encodes them in their original format. With a
+// quality between 1 and 100, JPEGs are re-encoded at it whatever their
+// width, but only kept when that makes them smaller. With gray, JPEG, PNG
+// and still GIF images are turned into 8-bit grayscale, transparent areas
+// becoming white. Other formats, and images that fail to decode, are
+// returned unchanged.
+func shrinkImage(data []byte, ext string, maxWidth, quality int, gray bool) []byte {
+	if ext == ".gif" && gray {
+		return grayGIF(data)
+	}
+	isJPEG := ext == ".jpg" || ext == ".jpeg"
+	if !isJPEG && ext != ".png" {
+		return data
+	}
+	if maxWidth <= 0 && !gray && (quality <= 0 || !isJPEG) {
+		return data
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data
+	}
+	b := img.Bounds()
+	resize := maxWidth > 0 && b.Dx() > maxWidth
+	if !resize && !gray && (quality <= 0 || !isJPEG) {
+		return data
+	}
+
+	dst := img
+	if resize {
+		height := b.Dy() * maxWidth / b.Dx()
+		if height < 1 {
+			height = 1
+		}
+		scaled := image.NewRGBA(image.Rect(0, 0, maxWidth, height))
+		draw.CatmullRom.Scale(scaled, scaled.Bounds(), img, b, draw.Over, nil)
+		dst = scaled
+	}
+	if gray {
+		dst = grayImage(dst)
+	}
+	if quality <= 0 {
+		quality = defaultJPEGQuality
+	}
+
+	var buf bytes.Buffer
+	if ext == ".png" {
+		err = png.Encode(&buf, dst)
+	} else {
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: quality})
+	}
+	if err != nil || (!resize && !gray && buf.Len() >= len(data)) {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// firstGIFFrame renders the first frame of an animated GIF as a PNG of
+// the full canvas. Still GIFs are refused, as they need no conversion.
+func firstGIFFrame(data []byte) ([]byte, error) {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(g.Image) < 2 {
+		return nil, errors.New("not animated")
+	}
+	frame := g.Image[0]
+	canvas := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	if canvas.Empty() {
+		canvas = frame.Bounds()
+	}
+	dst := image.NewRGBA(canvas)
+	draw.Draw(dst, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, dst); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// grayImage converts img to 8-bit grayscale on a white background.
+func grayImage(img image.Image) *image.Gray {
+	b := img.Bounds()
+	dst := image.NewGray(b)
+	draw.Draw(dst, b, flattenAlpha(img), b.Min, draw.Src)
+	return dst
+}
+
+// grayPalette holds the 256 levels of gray, so a grayscale GIF keeps every
+// one of them.
+var grayPalette = func() color.Palette {
+	p := make(color.Palette, 256)
+	for i := range p {
+		p[i] = color.Gray{Y: uint8(i)}
+	}
+	return p
+}()
+
+// grayGIF converts a single-frame GIF to grayscale. Animations are
+// returned unchanged, like GIFs that fail to decode.
+func grayGIF(data []byte) []byte {
+	g, err := gif.DecodeAll(bytes.NewReader(data))
+	if err != nil || len(g.Image) != 1 {
+		return data
+	}
+	src := grayImage(g.Image[0])
+	dst := image.NewPaletted(src.Bounds(), grayPalette)
+	draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Src)
+	var buf bytes.Buffer
+	if err := gif.Encode(&buf, dst, nil); err != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
+// flattenAlpha draws img onto a white background, since JPEG has no alpha channel.
+func flattenAlpha(img image.Image) image.Image {
+	b := img.Bounds()
+	dst := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, a := img.At(x, y).RGBA()
+			inv := 0xffff - a
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r + inv),
+				G: uint16(g + inv),
+				B: uint16(bl + inv),
+				A: 0xffff,
+			})
+		}
+	}
+	return dst
+}
+
+// embedImages downloads the images referenced by doc and points their src
+// at the embedded copies: EPUB resources staged in tmpDir, or data: URIs
+// for the html and fb2 formats, or files in the assets folder for md.
+// EPUB resources are numbered from *counter, which is advanced so that
+// several documents can share one book. It returns a description of every
+// image that could not be embedded, and reports the WebP images it
+// transcoded.
+func embedImages(ctx context.Context, doc *goquery.Document, base *url.URL, e *epub.Epub, tmpDir string, counter *int, opts *Options) []string {
+	var failedImages, transcoded []string
+
+	// Collect the images first so they can be fetched concurrently while
+	// file names are still assigned in document order.
+	var jobs []*imageJob
+	jobsByURL := make(map[string]*imageJob)
+	doc.Find("img").Each(func(i int, s *goquery.Selection) {
+		src := imageSource(s)
+		if src == "" {
+			opts.debugf("skipping <img> without a usable source")
+			return
+		}
+
+		// Resolve relative URLs against the article URL
+		imgURL, err := base.Parse(src)
+		if err != nil {
+			failedImages = append(failedImages, fmt.Sprintf("%s: %v", src, err))
+			return
+		}
+		// Repeated images are downloaded and stored only once.
+		if job, ok := jobsByURL[imgURL.String()]; ok {
+			job.sels = append(job.sels, s)
+			return
+		}
+		job := &imageJob{sels: []*goquery.Selection{s}, url: imgURL}
+		jobsByURL[imgURL.String()] = job
+		jobs = append(jobs, job)
+	})
+
+	fetchImages(ctx, jobs, opts)
+
+	for _, job := range jobs {
+		imgURL := job.url
+		if job.err != nil {
+			failedImages = append(failedImages, fmt.Sprintf("%s: %v", imgURL, job.err))
+			continue
+		}
+		data, ext := job.data, job.ext
+		opts.debugf("fetched image %s (%d bytes)", imgURL, len(data))
+
+		if ext == "" {
+			// Try to guess extension from URL path as a fallback
+			ext = filepath.Ext(imgURL.Path)
+		}
+		if ext == "" {
+			ext = ".img"
+		}
+
+		// Tracking pixels, counters and icons only bloat the book.
+		if reason := tinyImage(data, ext, opts); reason != "" {
+			opts.debugf("dropped image %s: %s", imgURL, reason)
+			for _, sel := range job.sels {
+				dropImage(sel)
+			}
+			continue
+		}
+		// There is no AVIF decoder to convert with, and few readers show it.
+		if ext == ".avif" {
+			opts.logf("warning: dropped image %s: AVIF cannot be converted", imgURL)
+			for _, sel := range job.sels {
+				dropImage(sel)
+			}
+			continue
+		}
+
+		// Transcode still WebP images for readers without WebP support.
+		// Animated ones are kept as-is, since only the first frame would survive.
+		// FB2 has no WebP at all, so there "keep" means "auto".
+		webpMode := opts.WebPMode
+		if opts.Format == "fb2" && webpMode == "keep" {
+			webpMode = "auto"
+		}
+		if ext == ".webp" && webpMode != "keep" && !isAnimatedWebP(data) {
+			converted, newExt, err := transcodeWebP(data, webpMode, opts.JPEGQuality)
+			if err == nil {
+				data, ext = converted, newExt
+				transcoded = append(transcoded, fmt.Sprintf("%s (to %s)", imgURL, strings.ToUpper(strings.TrimPrefix(newExt, "."))))
+			} else {
+				opts.logf("warning: failed to transcode WebP image %s: %v", imgURL, err)
+			}
+		}
+		// E-ink readers show animations blank or half drawn.
+		if ext == ".gif" && opts.GIFMode == "first-frame" {
+			if frame, err := firstGIFFrame(data); err == nil {
+				data, ext = frame, ".png"
+				opts.debugf("replaced animated GIF %s with its first frame", imgURL)
+			}
+		}
+
+		// Rasterized SVGs fall back to the original when rendering fails.
+		if ext == ".svg" && opts.SVGImageWidth > 0 {
+			if raster, err := rasterizeSVGImage(data, opts.SVGImageWidth); err == nil {
+				data, ext = raster, ".png"
+				opts.debugf("rasterized %s to PNG", imgURL)
+			} else {
+				opts.logf("warning: kept SVG image %s, failed to rasterize it: %v", imgURL, err)
+			}
+		}
+
+		data = shrinkImage(data, ext, opts.MaxImageWidth, opts.JPEGQuality, opts.Grayscale)
+
+		if opts.inlineImages() {
+			// Single-file formats carry their images inline.
+			uri := dataURI(data, ext)
+			for _, sel := range job.sels {
+				setImageSource(sel, uri)
+			}
+			continue
+		}
+		if opts.Format == "md" {
+			path, err := stageAsset(tmpDir, data, ext)
+			if err != nil {
+				failedImages = append(failedImages, fmt.Sprintf("%s: %v", imgURL, err))
+				continue
+			}
+			for _, sel := range job.sels {
+				setImageSource(sel, path)
+			}
+			continue
+		}
+
+		imgFileName := fmt.Sprintf("image_%03d%s", *counter, ext)
+		*counter++
+
+		tmpPath := filepath.Join(tmpDir, imgFileName)
+
+		if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+			failedImages = append(failedImages, fmt.Sprintf("%s: %v", imgURL, err))
+			continue
+		}
+
+		// go-epub AddImage expects a filesystem path.
+		imgPath, err := e.AddImage(tmpPath, imgFileName)
+		if err != nil {
+			failedImages = append(failedImages, fmt.Sprintf("%s: %v", imgURL, err))
+			continue
+		}
+
+		// Update the img src to point to the EPUB image path
+		for _, sel := range job.sels {
+			setImageSource(sel, imgPath)
+		}
+	}
+
+	if len(transcoded) > 0 {
+		opts.logf("transcoded %d WebP image(s):\n  %s", len(transcoded), strings.Join(transcoded, "\n  "))
+	}
+	return failedImages
+}
+
+// tinyImage reports why an image falls below Options.MinImageBytes or
+// Options.MinImageSize, or returns "" when it is large enough. With a size
+// threshold, data of no known image format is dropped as well, since no
+// reader could show it; SVGs have no pixel size and only face the byte
+// threshold.
+func tinyImage(data []byte, ext string, opts *Options) string {
+	if opts.MinImageBytes > 0 && len(data) < opts.MinImageBytes {
+		return fmt.Sprintf("%d bytes", len(data))
+	}
+	if opts.MinImageSize <= 0 || ext == ".svg" {
+		return ""
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		if ext == ".img" {
+			return "not an image"
+		}
+		return ""
+	}
+	if cfg.Width < opts.MinImageSize || cfg.Height < opts.MinImageSize {
+		return fmt.Sprintf("%d×%d pixels", cfg.Width, cfg.Height)
+	}
+	return ""
+}
+
+// dropImage removes an <img> from the document, along with a link around
+// it that holds nothing else.
+func dropImage(s *goquery.Selection) {
+	if a := s.Parent().Filter("a"); a.Length() > 0 && a.Children().Length() == 1 && strings.TrimSpace(a.Text()) == "" {
+		a.Remove()
+		return
+	}
+	s.Remove()
+}
+
+// embedCover sets the EPUB cover from the page's Open Graph image, falling
+// back to the first image embedded in doc and then to a cover drawn from
+// text. With Options.GenerateCover the drawn cover is always used. A WebP
+// Open Graph image is transcoded like the images of the text, and an AVIF
+// one is skipped.
+func embedCover(ctx context.Context, page, doc *goquery.Document, base *url.URL, e *epub.Epub, tmpDir string, text coverText, opts *Options) {
+	var coverPath string
+	if coverURL := extractCoverURL(page, base); coverURL != nil && !opts.GenerateCover {
+		data, ext, err := opts.fetchBinary(ctx, coverURL.String())
+		if err == nil && ext == "" {
+			err = errors.New("not an image")
+		}
+		if err == nil && ext == ".avif" {
+			err = errors.New("AVIF cannot be converted")
+		}
+		if err == nil && ext == ".webp" && opts.WebPMode != "keep" && !isAnimatedWebP(data) {
+			data, ext, err = transcodeWebP(data, opts.WebPMode, opts.JPEGQuality)
+		}
+		if err == nil {
+			// The cover is shown as a thumbnail or a full screen at most.
+			data = shrinkImage(data, ext, coverWidth, opts.JPEGQuality, opts.Grayscale)
+			name := "cover" + ext
+			tmpPath := filepath.Join(tmpDir, name)
+			if err = os.WriteFile(tmpPath, data, 0o600); err == nil {
+				coverPath, err = e.AddImage(tmpPath, name)
+			}
+		}
+		if err != nil {
+			opts.logf("warning: failed to embed cover %s: %v", coverURL, err)
+		} else {
+			opts.debugf("fetched cover %s (%d bytes)", coverURL, len(data))
+		}
+	}
+	if coverPath == "" && !opts.GenerateCover {
+		// Embedded images point at the EPUB's images folder; remote ones
+		// that failed to download do not.
+		doc.Find("img").EachWithBreak(func(i int, s *goquery.Selection) bool {
+			if src := s.AttrOr("src", ""); strings.HasPrefix(src, "../images/") {
+				coverPath = src
+				return false
+			}
+			return true
+		})
+	}
+	if coverPath == "" {
+		data, err := drawCover(text)
+		if err == nil {
+			data = shrinkImage(data, ".png", 0, 0, opts.Grayscale)
+			tmpPath := filepath.Join(tmpDir, "cover.png")
+			if err = os.WriteFile(tmpPath, data, 0o600); err == nil {
+				coverPath, err = e.AddImage(tmpPath, "cover.png")
+			}
+		}
+		if err != nil {
+			opts.logf("warning: failed to generate cover: %v", err)
+		}
+	}
+	if coverPath != "" {
+		e.SetCover(coverPath, "")
+	}
+}
+
+// stripImages replaces every <img> with its alt text in brackets, or
+// removes it when there is none.
+func stripImages(doc *goquery.Document) {
+	doc.Find("img").Each(func(i int, s *goquery.Selection) {
+		if alt := strings.TrimSpace(s.AttrOr("alt", "")); alt != "" {
+			s.ReplaceWithHtml(html.EscapeString("[" + alt + "]"))
+			return
+		}
+		s.Remove()
+	})
+}
@@ -0,0 +1,225 @@
+package habrdl
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/bmaupin/go-epub"
+)
+
+// testPNG returns a w×h PNG.
+func testPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewGray(image.Rect(0, 0, w, h))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// countingServer serves body with contentType and counts the requests
+// for every path.
+func countingServer(t *testing.T, contentType string, body []byte) (*httptest.Server, map[string]*int32) {
+	t.Helper()
+	counts := map[string]*int32{}
+	for _, p := range []string{"/logo.png", "/other.png"} {
+		counts[p] = new(int32)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n, ok := counts[r.URL.Path]; ok {
+			atomic.AddInt32(n, 1)
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, counts
+}
+
+func TestEmbedImagesDeduplicates(t *testing.T) {
+	srv, counts := countingServer(t, "image/png", testPNG(t, 40, 30))
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<div>
+		<img src="/logo.png"><p>one</p>
+		<img src="` + srv.URL + `/logo.png"><p>two</p>
+		<a href="#"><img src="logo.png"></a>
+		<img src="/other.png">
+	</div>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := url.Parse(srv.URL + "/")
+	opts := &Options{Fetcher: NewFetcher(srv.Client()), Format: "epub", Concurrency: 4}
+	counter := 1
+
+	failed := embedImages(context.Background(), doc, base, epub.NewEpub("t"), t.TempDir(), &counter, opts)
+	if len(failed) > 0 {
+		t.Fatalf("embedImages failed: %v", failed)
+	}
+	if n := atomic.LoadInt32(counts["/logo.png"]); n != 1 {
+		t.Errorf("the repeated image was fetched %d times, want once", n)
+	}
+	if n := atomic.LoadInt32(counts["/other.png"]); n != 1 {
+		t.Errorf("the other image was fetched %d times, want once", n)
+	}
+	var srcs []string
+	doc.Find("img").Each(func(i int, s *goquery.Selection) {
+		srcs = append(srcs, s.AttrOr("src", ""))
+	})
+	if len(srcs) != 4 || srcs[0] != srcs[1] || srcs[1] != srcs[2] || srcs[2] == srcs[3] {
+		t.Errorf("image sources = %q, want the first three equal and the fourth different", srcs)
+	}
+	if counter != 3 {
+		t.Errorf("%d images were added, want 2", counter-1)
+	}
+}
+
+func TestBinaryMemo(t *testing.T) {
+	srv, counts := countingServer(t, "image/png", testPNG(t, 40, 30))
+	f := NewFetcher(srv.Client())
+	memo := &binaryMemo{}
+	for i := 0; i < 3; i++ {
+		data, ext, err := memo.fetch(context.Background(), f, srv.URL+"/logo.png")
+		if err != nil || ext != ".png" || len(data) == 0 {
+			t.Fatalf("fetch %d = %d bytes, %q, %v", i+1, len(data), ext, err)
+		}
+	}
+	if n := atomic.LoadInt32(counts["/logo.png"]); n != 1 {
+		t.Errorf("memo fetched the image %d times, want once", n)
+	}
+}
+
+// testWebP is a 1×1 lossless WebP.
+const testWebP = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func TestEmbedImagesDropsAVIF(t *testing.T) {
+	srv, _ := countingServer(t, "image/avif", []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1"))
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<p>text <img src="/logo.png"></p>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := url.Parse(srv.URL + "/")
+	var warnings []string
+	opts := &Options{Fetcher: NewFetcher(srv.Client()), Format: "epub", Logf: func(format string, args ...interface{}) {
+		warnings = append(warnings, fmt.Sprintf(format, args...))
+	}}
+	counter := 1
+
+	if failed := embedImages(context.Background(), doc, base, epub.NewEpub("t"), t.TempDir(), &counter, opts); len(failed) > 0 {
+		t.Fatalf("embedImages failed: %v", failed)
+	}
+	if n := doc.Find("img").Length(); n != 0 {
+		t.Errorf("%d AVIF images left, want 0", n)
+	}
+	if len(warnings) != 1 || !strings.Contains(warnings[0], srv.URL+"/logo.png") {
+		t.Errorf("warnings = %q, want one naming the image", warnings)
+	}
+}
+
+func TestEmbedCoverTranscodesWebP(t *testing.T) {
+	data, err := base64.StdEncoding.DecodeString(testWebP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := countingServer(t, "image/webp", data)
+	page, err := goquery.NewDocumentFromReader(strings.NewReader(`<html><head><meta property="og:image" content="/logo.png"></head></html>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := url.Parse(srv.URL + "/")
+	tmpDir := t.TempDir()
+	opts := &Options{Fetcher: NewFetcher(srv.Client()), Format: "epub", WebPMode: "auto", Logf: t.Logf}
+
+	embedCover(context.Background(), page, page, base, epub.NewEpub("t"), tmpDir, coverText{title: "t"}, opts)
+	// A drawn cover would be a PNG too, but not 1×1.
+	cover, err := os.ReadFile(filepath.Join(tmpDir, "cover.png"))
+	if err != nil {
+		t.Fatalf("no PNG cover: %v", err)
+	}
+	if cfg, err := png.DecodeConfig(bytes.NewReader(cover)); err != nil || cfg.Width != 1 {
+		t.Errorf("cover is %d pixels wide (%v), want the 1-pixel og:image", cfg.Width, err)
+	}
+}
+
+func TestEmbedImagesReportsWebP(t *testing.T) {
+	data, err := base64.StdEncoding.DecodeString(testWebP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, _ := countingServer(t, "image/webp", data)
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(`<p><img src="/logo.png"><img src="/other.png"></p>`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := url.Parse(srv.URL + "/")
+	var messages []string
+	opts := &Options{Fetcher: NewFetcher(srv.Client()), Format: "epub", WebPMode: "png", Logf: func(format string, args ...interface{}) {
+		messages = append(messages, fmt.Sprintf(format, args...))
+	}}
+	counter := 1
+
+	if failed := embedImages(context.Background(), doc, base, epub.NewEpub("t"), t.TempDir(), &counter, opts); len(failed) > 0 {
+		t.Fatalf("embedImages failed: %v", failed)
+	}
+	if len(messages) != 1 || !strings.HasPrefix(messages[0], "transcoded 2 WebP image(s)") ||
+		!strings.Contains(messages[0], srv.URL+"/logo.png (to PNG)") || !strings.Contains(messages[0], srv.URL+"/other.png (to PNG)") {
+		t.Errorf("messages = %q, want one summary naming both images", messages)
+	}
+	doc.Find("img").Each(func(i int, s *goquery.Selection) {
+		if src := s.AttrOr("src", ""); !strings.HasSuffix(src, ".png") {
+			t.Errorf("image %d points at %q, want a .png resource", i, src)
+		}
+	})
+}
+
+func TestImageSourcePicture(t *testing.T) {
+	tests := []struct {
+		name string
+		html string
+		want string
+	}{
+		{
+			"AVIF source skipped",
+			`<picture><source type="image/avif" srcset="/big.avif 2000w"><img src="/photo.jpg" srcset="/photo.jpg 800w"></picture>`,
+			"/photo.jpg",
+		},
+		{
+			"AVIF source without srcset on img",
+			`<picture><source type="image/avif" srcset="/big.avif 2000w"><img src="/photo.jpg"></picture>`,
+			"/photo.jpg",
+		},
+		{
+			"WebP source used",
+			`<picture><source type="image/webp" srcset="/big.webp 2000w"><img src="/photo.jpg" srcset="/photo.jpg 800w"></picture>`,
+			"/big.webp",
+		},
+		{
+			"untyped source used",
+			`<picture><source srcset="/big.jpg 2000w"><img src="/photo.jpg"></picture>`,
+			"/big.jpg",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := goquery.NewDocumentFromReader(strings.NewReader(tt.html))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := imageSource(doc.Find("img")); got != tt.want {
+				t.Errorf("imageSource = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package habrdl
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// jsonArticle is one article of the json format.
+type jsonArticle struct {
+	URL            string      `json:"url"`
+	ID             string      `json:"id,omitempty"`
+	Title          string      `json:"title"`
+	Author         string      `json:"author"`
+	Published      string      `json:"published,omitempty"`
+	Description    string      `json:"description,omitempty"`
+	Lang           string      `json:"lang"`
+	Hubs           []string    `json:"hubs"`
+	Tags           []string    `json:"tags"`
+	Cover          string      `json:"cover,omitempty"`
+	Words          int         `json:"words"`
+	ReadingMinutes int         `json:"readingMinutes"`
+	HTML           string      `json:"html"`
+	Images         []jsonImage `json:"images"`
+}
+
+// jsonImage is an image referenced by the article HTML.
+type jsonImage struct {
+	URL string `json:"url"`
+	Alt string `json:"alt,omitempty"`
+}
+
+// jsonBook renders the parts as JSON: an object for a single article, an
+// array of them for a series. Image sources in the HTML are made absolute
+// and listed in the order they appear, without duplicates.
+func jsonBook(parts []*part) (string, error) {
+	articles := make([]jsonArticle, 0, len(parts))
+	for _, p := range parts {
+		a := jsonArticle{
+			URL:            p.url.String(),
+			ID:             articleID(p.url),
+			Title:          p.title,
+			Author:         p.author,
+			Published:      p.published,
+			Description:    p.summary,
+			Lang:           p.lang,
+			Hubs:           nonNil(extractNames(p.page, hubSelector)),
+			Tags:           nonNil(extractNames(p.page, tagSelector)),
+			Words:          p.words,
+			ReadingMinutes: readingMinutes(p.words),
+			Images:         []jsonImage{},
+		}
+		if cover := extractCoverURL(p.page, p.url); cover != nil {
+			a.Cover = cover.String()
+		}
+		seen := make(map[string]bool)
+		p.doc.Find("img").Each(func(i int, s *goquery.Selection) {
+			src := imageSource(s)
+			u, err := p.url.Parse(src)
+			if src == "" || err != nil {
+				return
+			}
+			setImageSource(s, u.String())
+			if !seen[u.String()] {
+				seen[u.String()] = true
+				a.Images = append(a.Images, jsonImage{URL: u.String(), Alt: strings.TrimSpace(s.AttrOr("alt", ""))})
+			}
+		})
+		body, err := p.doc.Find("body").Html()
+		if err != nil {
+			return "", fmt.Errorf("failed to serialize body HTML: %w", err)
+		}
+		a.HTML = strings.TrimSpace(body)
+		articles = append(articles, a)
+	}
+
+	var v interface{} = articles
+	if len(articles) == 1 {
+		v = articles[0]
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode JSON: %w", err)
+	}
+	return string(data) + "\n", nil
+}
+
+// nonNil returns s, or an empty slice when s is nil, so it is encoded as
+// [] rather than null.
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
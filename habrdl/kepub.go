@@ -0,0 +1,94 @@
+package habrdl
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"golang.org/x/net/html"
+)
+
+// sentencePattern splits text into sentences, each keeping its closing
+// punctuation, quotes and the whitespace after it.
+var sentencePattern = regexp.MustCompile(`[^.!?…]*[.!?…]+[»”"')\]]*\s*|[^.!?…]+$`)
+
+// kepubBlocks are the elements that start a new paragraph number in the
+// koboSpan ids.
+var kepubBlocks = map[string]bool{
+	"p": true, "div": true, "li": true, "blockquote": true, "figure": true, "figcaption": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"td": true, "th": true, "dt": true, "dd": true, "table": true,
+}
+
+// kepubSkip are the elements whose content is left unwrapped.
+var kepubSkip = map[string]bool{"pre": true, "script": true, "style": true, "svg": true, "math": true}
+
+// kepubHTML turns the body of an EPUB section into Kobo's kepub flavor:
+// every sentence and image is wrapped in a koboSpan numbered by paragraph
+// and position, which Kobo readers use for page statistics and
+// highlights, and the content goes into the book-columns and book-inner
+// divs they lay out. The body is returned unchanged if it cannot be
+// parsed.
+func kepubHTML(body string) string {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(sectionHTML(body)))
+	if err != nil {
+		return body
+	}
+	root := doc.Find("body")
+	if root.Length() == 0 {
+		return body
+	}
+	k := &kepubSpans{}
+	k.walk(root.Get(0))
+	inner, err := root.Html()
+	if err != nil {
+		return body
+	}
+	return `<div id="book-columns"><div id="book-inner">` + inner + "</div></div>"
+}
+
+// kepubSpans numbers the koboSpans of one section.
+type kepubSpans struct {
+	para, seg int
+}
+
+// walk wraps the text and images below n.
+func (k *kepubSpans) walk(n *html.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		switch {
+		case c.Type == html.TextNode && strings.TrimSpace(c.Data) != "":
+			for _, sentence := range sentencePattern.FindAllString(c.Data, -1) {
+				span := k.span()
+				span.AppendChild(&html.Node{Type: html.TextNode, Data: sentence})
+				n.InsertBefore(span, c)
+			}
+			n.RemoveChild(c)
+		case c.Type == html.ElementNode && c.Data == "img":
+			span := k.span()
+			n.InsertBefore(span, c)
+			n.RemoveChild(c)
+			span.AppendChild(c)
+		case c.Type == html.ElementNode && !kepubSkip[c.Data]:
+			if kepubBlocks[c.Data] {
+				k.para++
+				k.seg = 0
+			}
+			k.walk(c)
+		}
+		c = next
+	}
+}
+
+// span returns the next empty koboSpan.
+func (k *kepubSpans) span() *html.Node {
+	if k.para == 0 {
+		k.para = 1
+	}
+	k.seg++
+	return &html.Node{Type: html.ElementNode, Data: "span", Attr: []html.Attribute{
+		{Key: "class", Val: "koboSpan"},
+		{Key: "id", Val: fmt.Sprintf("kobo.%d.%d", k.para, k.seg)},
+	}}
+}
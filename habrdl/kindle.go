@@ -0,0 +1,91 @@
+package habrdl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// converterFormats are the formats built as an EPUB first and then handed
+// to an external converter.
+var converterFormats = map[string]bool{"mobi": true, "azw3": true, "pdf": true}
+
+// CheckConverter reports an error when format needs an external converter
+// that is not installed. Formats go-epub writes itself always pass.
+func CheckConverter(format string) error {
+	if !converterFormats[format] {
+		return nil
+	}
+	_, err := findConverter(format)
+	return err
+}
+
+// findConverter looks up a program on PATH that turns an EPUB into format:
+// Calibre's ebook-convert, or kindlegen, which only writes MOBI.
+func findConverter(format string) (string, error) {
+	if path, err := exec.LookPath("ebook-convert"); err == nil {
+		return path, nil
+	}
+	if format == "mobi" {
+		if path, err := exec.LookPath("kindlegen"); err == nil {
+			return path, nil
+		}
+		return "", errors.New("format mobi needs ebook-convert (Calibre) or kindlegen on PATH")
+	}
+	return "", fmt.Errorf("format %s needs ebook-convert (Calibre) on PATH", format)
+}
+
+// writeConverted stages the book as an EPUB, runs the converter on it and
+// copies the result to w.
+func (b *Book) writeConverted(w io.Writer) (int64, error) {
+	epubPath := filepath.Join(b.tmpDir, "book.epub")
+	if err := b.saveEPUB(epubPath); err != nil {
+		return 0, err
+	}
+	outPath := filepath.Join(b.tmpDir, "book"+b.Ext)
+	os.Remove(outPath)
+
+	var cmd *exec.Cmd
+	if strings.HasPrefix(filepath.Base(b.converter), "kindlegen") {
+		// kindlegen writes next to its input and takes only a file name.
+		cmd = exec.Command(b.converter, epubPath, "-o", filepath.Base(outPath))
+	} else {
+		args := []string{epubPath, outPath}
+		if b.Ext == ".pdf" {
+			args = append(args, "--pdf-page-numbers")
+		}
+		cmd = exec.Command(b.converter, args...)
+	}
+	output, err := cmd.CombinedOutput()
+	// kindlegen exits with 1 when it only had warnings.
+	if _, statErr := os.Stat(outPath); statErr != nil {
+		if err == nil {
+			err = statErr
+		}
+		return 0, fmt.Errorf("%s failed: %v\n%s", filepath.Base(b.converter), err, strings.TrimSpace(string(output)))
+	}
+
+	f, err := os.Open(outPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return io.Copy(w, f)
+}
+
+// saveEPUB writes the EPUB the book is built as to path.
+func (b *Book) saveEPUB(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := writeEPUB(f, b.epub, b.opfMeta, b.landmarks); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
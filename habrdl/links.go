@@ -0,0 +1,125 @@
+package habrdl
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// maxLinkedParts bounds how many articles a book may hold once linked
+// articles are followed.
+const maxLinkedParts = 50
+
+// collectLinked adds the Habr articles linked from the text of parts, and
+// those linked from them in turn, up to depth levels away. New parts are
+// appended in the order they are found; parts that fail to download are
+// skipped with a warning.
+func collectLinked(ctx context.Context, parts []*part, depth int, opts *Options) []*part {
+	visited := make(map[string]bool)
+	for _, p := range parts {
+		visited[seriesKey(p.url)] = true
+	}
+	level := parts
+	for d := 1; d <= depth && len(level) > 0; d++ {
+		var next []*part
+		for _, p := range level {
+			for _, u := range articleLinks(p, opts) {
+				key := seriesKey(u)
+				if visited[key] {
+					continue
+				}
+				if len(parts) >= maxLinkedParts {
+					opts.logf("warning: stopped following links at %d articles", maxLinkedParts)
+					return parts
+				}
+				visited[key] = true
+				linked, err := fetchPart(ctx, u.String(), opts)
+				if err != nil {
+					opts.logf("warning: skipped linked article %s: %v", u, err)
+					continue
+				}
+				parts = append(parts, linked)
+				next = append(next, linked)
+			}
+		}
+		opts.debugf("depth %d: %d linked article(s)", d, len(next))
+		level = next
+	}
+	return parts
+}
+
+// collectAnthology appends the articles at urls to parts, skipping those
+// already in the book and, with a warning, those that fail to download.
+func collectAnthology(ctx context.Context, parts []*part, urls []string, opts *Options) []*part {
+	visited := make(map[string]bool)
+	for _, p := range parts {
+		visited[seriesKey(p.url)] = true
+	}
+	for _, raw := range urls {
+		if u, err := url.Parse(raw); err == nil && visited[seriesKey(u)] {
+			opts.debugf("skipping %s (already in the book)", raw)
+			continue
+		}
+		p, err := fetchPart(ctx, raw, opts)
+		if err != nil {
+			opts.logf("warning: skipped article %s: %v", raw, err)
+			continue
+		}
+		visited[seriesKey(p.url)] = true
+		parts = append(parts, p)
+	}
+	opts.debugf("anthology has %d part(s)", len(parts))
+	return parts
+}
+
+// articleLinks returns the links in the text of p that point at articles.
+func articleLinks(p *part, opts *Options) []*url.URL {
+	var urls []*url.URL
+	p.doc.Find("a[href]").Each(func(i int, s *goquery.Selection) {
+		u, err := p.url.Parse(strings.TrimSpace(s.AttrOr("href", "")))
+		if err != nil || validateArticleURL(u, opts.AllowAnyHost) != nil {
+			return
+		}
+		u.RawQuery, u.Fragment = "", ""
+		urls = append(urls, u)
+	})
+	return urls
+}
+
+// partFile is the EPUB file name of the first section of part i.
+func partFile(i int) string {
+	return fmt.Sprintf("part_%03d.xhtml", i+1)
+}
+
+// partAnchor is the id of the heading of part i in the html format.
+func partAnchor(i int) string {
+	return fmt.Sprintf("part-%d", i+1)
+}
+
+// crossLinkParts points the links between parts at the parts inside the
+// book, target(i) giving the href of part i. Links to a fragment of an
+// article are left alone, since the fragment may not survive extraction.
+// It returns the number of rewritten links.
+func crossLinkParts(parts []*part, target func(i int) string) int {
+	index := make(map[string]int)
+	for i, p := range parts {
+		index[seriesKey(p.url)] = i
+	}
+	rewritten := 0
+	for _, p := range parts {
+		p.doc.Find("a[href]").Each(func(j int, s *goquery.Selection) {
+			u, err := p.url.Parse(strings.TrimSpace(s.AttrOr("href", "")))
+			if err != nil || u.Fragment != "" || !articlePathPattern.MatchString(u.Path) {
+				return
+			}
+			if i, ok := index[seriesKey(u)]; ok {
+				s.SetAttr("href", target(i))
+				rewritten++
+			}
+		})
+	}
+	return rewritten
+}
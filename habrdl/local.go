@@ -0,0 +1,83 @@
+package habrdl
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// readPageFile reads a saved page from disk, decompressing it when it is
+// gzipped (by its .gz name or its magic bytes).
+func readPageFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(strings.ToLower(path), ".gz") && !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, nil
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress %s: %w", path, err)
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// localizeImages points the images of a saved page that exist next to it,
+// like the files folder a browser saves along with the page, at file://
+// URLs, so readability does not resolve them against the base URL. It
+// returns the number of rewritten images.
+func localizeImages(page *goquery.Document, dir string) int {
+	localized := 0
+	page.Find("img").Each(func(i int, s *goquery.Selection) {
+		for _, attr := range append([]string{"src"}, lazyImageAttrs...) {
+			u, err := url.Parse(strings.TrimSpace(s.AttrOr(attr, "")))
+			if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" || strings.HasPrefix(u.Path, "/") {
+				continue
+			}
+			path := filepath.Join(dir, filepath.FromSlash(u.Path))
+			if info, err := os.Stat(path); err != nil || info.IsDir() {
+				continue
+			}
+			setImageSource(s, (&url.URL{Scheme: "file", Path: filepath.ToSlash(path)}).String())
+			localized++
+			return
+		}
+	})
+	return localized
+}
+
+// readLocalImage reads an image referenced by a file:// URL. Only files
+// within dir, the folder of the saved page, are read, so a page cannot
+// pull arbitrary local files into the book.
+func readLocalImage(u *url.URL, dir string) ([]byte, string, error) {
+	if dir == "" {
+		return nil, "", errors.New("file:// images are only read for pages loaded from a file")
+	}
+	path, err := filepath.Abs(filepath.FromSlash(u.Path))
+	if err != nil {
+		return nil, "", err
+	}
+	if rel, err := filepath.Rel(dir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, "", fmt.Errorf("%s is outside the folder of the page file", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	ext := extForContentType(http.DetectContentType(data))
+	if ext == "" {
+		ext = strings.ToLower(filepath.Ext(path))
+	}
+	return data, ext, nil
+}
@@ -0,0 +1,152 @@
+package habrdl
+
+import (
+	"fmt"
+	"html"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	md "github.com/JohannesKaufmann/html-to-markdown"
+	"github.com/JohannesKaufmann/html-to-markdown/plugin"
+	"github.com/PuerkitoBio/goquery"
+)
+
+// assetsDir is the folder next to a Markdown book that holds its images.
+const assetsDir = "assets"
+
+// stageAsset writes an image of a Markdown book into the assets folder
+// staged in tmpDir and returns the relative path to reference it with.
+// Images are named after their content, so books saved into the same
+// directory share one assets folder without clashes.
+func stageAsset(tmpDir string, data []byte, ext string) (string, error) {
+	dir := filepath.Join(tmpDir, assetsDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	name := hashHex(data)[:16] + ext
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+		return "", err
+	}
+	return assetsDir + "/" + name, nil
+}
+
+// writeAssets copies the staged images of a Markdown book into the
+// assets folder in dir. Files already there are kept, since an equal name
+// means equal content.
+func (b *Book) writeAssets(dir string) error {
+	staged := filepath.Join(b.tmpDir, assetsDir)
+	entries, err := os.ReadDir(staged)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(dir, assetsDir)
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(target, entry.Name())
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(staged, entry.Name()))
+		if err != nil {
+			return err
+		}
+		if err := writeFileAtomic(path, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markdownConverter returns a converter to GitHub-flavored Markdown, with
+// fenced code blocks, captions below their images and footnote markers as
+// [^n] references.
+func markdownConverter() *md.Converter {
+	conv := md.NewConverter("", true, &md.Options{
+		HeadingStyle:   "atx",
+		CodeBlockStyle: "fenced",
+		EmDelimiter:    "*",
+	})
+	conv.Use(plugin.GitHubFlavored())
+	conv.AddRules(md.Rule{
+		// Figures are blocks, with the caption on a line of its own.
+		Filter: []string{"figure"},
+		Replacement: func(content string, s *goquery.Selection, opt *md.Options) *string {
+			block := "\n\n" + strings.TrimSpace(content) + "\n\n"
+			return &block
+		},
+	}, md.Rule{
+		Filter: []string{"figcaption"},
+		Replacement: func(content string, s *goquery.Selection, opt *md.Options) *string {
+			caption := strings.TrimSpace(content)
+			if caption != "" {
+				caption = "\n\n*" + caption + "*"
+			}
+			return &caption
+		},
+	}, md.Rule{
+		Filter: []string{"sup"},
+		Replacement: func(content string, s *goquery.Selection, opt *md.Options) *string {
+			if !s.HasClass("footnote-ref") {
+				return nil
+			}
+			ref := "[^" + strings.Trim(strings.TrimSpace(s.Text()), "[]") + "]"
+			return &ref
+		},
+	})
+	return conv
+}
+
+// markdownBook renders the book as Markdown, preceded by YAML front
+// matter with its metadata, which note-taking apps such as Obsidian read
+// as the note properties. Footnotes become Markdown footnotes.
+func markdownBook(title string, lead *part, rendered []renderedPart, appendix string, refs *references) (string, error) {
+	var buf strings.Builder
+	buf.WriteString("---\ntitle: " + strconv.Quote(title) + "\n")
+	buf.WriteString("author: " + strconv.Quote(lead.author) + "\n")
+	if lead.published != "" {
+		buf.WriteString("date: " + lead.published + "\n")
+	}
+	buf.WriteString("source: " + strconv.Quote(lead.url.String()) + "\n")
+	if len(rendered) == 1 && lead.summary != "" {
+		buf.WriteString("description: " + strconv.Quote(lead.summary) + "\n")
+	}
+	if subjects := extractSubjects(lead.page); len(subjects) > 0 {
+		buf.WriteString("tags:\n")
+		for _, subject := range subjects {
+			buf.WriteString("  - " + strconv.Quote(subject) + "\n")
+		}
+	}
+	buf.WriteString("---\n\n# " + strings.TrimSpace(title) + "\n\n")
+
+	conv := markdownConverter()
+	for _, r := range rendered {
+		var body strings.Builder
+		if len(rendered) > 1 {
+			body.WriteString("<h1>" + html.EscapeString(r.title) + "</h1>")
+		}
+		body.WriteString(r.body + r.footer + r.comments)
+		text, err := conv.ConvertString(body.String())
+		if err != nil {
+			return "", fmt.Errorf("failed to convert to Markdown: %w", err)
+		}
+		buf.WriteString(strings.TrimSpace(text) + "\n\n")
+	}
+	if appendix != "" {
+		text, err := conv.ConvertString(appendix)
+		if err != nil {
+			return "", fmt.Errorf("failed to convert to Markdown: %w", err)
+		}
+		buf.WriteString(strings.TrimSpace(text) + "\n\n")
+	}
+	for i, u := range refs.urls {
+		fmt.Fprintf(&buf, "[^%d]: <%s>\n", i+1, u)
+	}
+	return strings.TrimRight(buf.String(), "\n") + "\n", nil
+}
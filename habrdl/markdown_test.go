@@ -0,0 +1,81 @@
+package habrdl
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// The table of the fixture sits in Habr's scrolling wrappers, which
+// readability would drop together with the table.
+func TestTableRoundTrip(t *testing.T) {
+	articleURL := serveArticle(t, "100", "testdata/table_article.html")
+
+	t.Run("html", func(t *testing.T) {
+		var buf bytes.Buffer
+		if _, err := convertFixture(t, articleURL, "html").WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		doc, err := goquery.NewDocumentFromReader(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		table := doc.Find("table")
+		if table.Length() != 1 {
+			t.Fatalf("found %d tables, want 1", table.Length())
+		}
+		if n := table.Find("th").Length(); n != 3 {
+			t.Errorf("table has %d header cells, want 3", n)
+		}
+		var rows [][]string
+		table.Find("tbody tr").Each(func(i int, tr *goquery.Selection) {
+			var cells []string
+			tr.Find("td").Each(func(j int, td *goquery.Selection) {
+				cells = append(cells, strings.TrimSpace(td.Text()))
+			})
+			rows = append(rows, cells)
+		})
+		want := [][]string{{"EPUB", "почти все", "внутри архива"}, {"FB2", "PocketBook", "base64"}}
+		if len(rows) != len(want) {
+			t.Fatalf("table rows = %q, want %q", rows, want)
+		}
+		for i := range want {
+			if strings.Join(rows[i], "|") != strings.Join(want[i], "|") {
+				t.Errorf("row %d = %q, want %q", i, rows[i], want[i])
+			}
+		}
+		if table.ParentsFiltered(".table-wrapper").Length() > 0 {
+			t.Error("the scrolling wrapper around the table was kept")
+		}
+	})
+
+	t.Run("md", func(t *testing.T) {
+		var buf bytes.Buffer
+		if _, err := convertFixture(t, articleURL, "md").WriteTo(&buf); err != nil {
+			t.Fatal(err)
+		}
+		markdown := buf.String()
+		for _, line := range []string{
+			"| Формат | Читалки | Картинки |",
+			"| EPUB | почти все | внутри архива |",
+			"| FB2 | PocketBook | base64 |",
+		} {
+			if !strings.Contains(markdown, line) {
+				t.Errorf("Markdown lacks the table line %q:\n%s", line, markdown)
+			}
+		}
+	})
+}
+
+func TestMarkdownConverterTable(t *testing.T) {
+	got, err := markdownConverter().ConvertString(`<table><thead><tr><th>A</th><th>B</th></tr></thead><tbody><tr><td>1</td><td>x | y</td></tr></tbody></table>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(got), "\n")
+	if len(lines) != 3 || lines[0] != "| A | B |" || !strings.HasPrefix(lines[1], "| --") || !strings.HasPrefix(lines[2], "| 1 |") {
+		t.Errorf("converted table = %q", got)
+	}
+}
@@ -0,0 +1,116 @@
+package habrdl
+
+import (
+	"html"
+	"net/url"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// replaceKaTeX rewrites the KaTeX formulas of page, which come as a pile of
+// positioned spans readability cannot follow. With mode "mathml" the
+// MathML KaTeX renders alongside is kept; otherwise the TeX source from
+// its annotation is shown as code between \( \) or, for display formulas,
+// \[ \] delimiters. Formulas without a TeX source are left alone. It
+// returns the number of replaced formulas.
+func replaceKaTeX(page *goquery.Document, mode string) int {
+	replaced := 0
+	page.Find(".katex").Each(func(i int, s *goquery.Selection) {
+		// Display formulas wrap the .katex span in .katex-display.
+		target := s
+		display := false
+		if parent := s.Parent(); parent.HasClass("katex-display") {
+			target = parent
+			display = true
+		}
+
+		if mode == "mathml" {
+			if math := s.Find("math").First(); math.Length() > 0 {
+				math.Find("annotation").Remove()
+				if display {
+					math.SetAttr("display", "block")
+				}
+				if markup, err := goquery.OuterHtml(math); err == nil {
+					target.ReplaceWithHtml(markup)
+					replaced++
+				}
+				return
+			}
+		}
+
+		tex := strings.TrimSpace(s.Find(`annotation[encoding="application/x-tex"]`).First().Text())
+		if tex == "" {
+			return
+		}
+		if display {
+			target.ReplaceWithHtml(`<pre class="math"><code>\[` + html.EscapeString(tex) + `\]</code></pre>`)
+		} else {
+			target.ReplaceWithHtml(`<code class="math">\(` + html.EscapeString(tex) + `\)</code>`)
+		}
+		replaced++
+	})
+	return replaced
+}
+
+// formulaImageHosts render the TeX in their URL path as an image; Habr's
+// editor used them for formulas before it rendered them itself.
+var formulaImageHosts = []string{"tex.s2cms.ru", "latex.codecogs.com"}
+
+// formulaTeX returns the TeX source of a formula image: the source
+// attribute of Habr's img.formula, or the TeX in the URL of an image from
+// formulaImageHosts. It returns "" for other images.
+func formulaTeX(s *goquery.Selection) string {
+	if s.HasClass("formula") {
+		if tex := strings.TrimSpace(s.AttrOr("source", "")); tex != "" {
+			return tex
+		}
+	}
+	u, err := url.Parse(s.AttrOr("src", ""))
+	if err != nil {
+		return ""
+	}
+	for _, host := range formulaImageHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			tex := u.RawQuery
+			if tex == "" {
+				tex = u.EscapedPath()[strings.LastIndex(u.EscapedPath(), "/")+1:]
+			}
+			if unescaped, err := url.PathUnescape(tex); err == nil {
+				return strings.TrimSpace(unescaped)
+			}
+		}
+	}
+	return ""
+}
+
+// replaceFormulaImages handles the formulas that Habr serves as rendered
+// images. With mode "mathml" they stay images, embedded like any other,
+// since there is no MathML for them; otherwise they are shown as TeX code
+// like the KaTeX formulas, which keeps them legible on readers that cannot
+// show SVG. It returns the number of replaced formulas.
+func replaceFormulaImages(page *goquery.Document, mode string) int {
+	if mode == "mathml" {
+		return 0
+	}
+	replaced := 0
+	page.Find("img").Each(func(i int, s *goquery.Selection) {
+		tex := formulaTeX(s)
+		if tex == "" {
+			return
+		}
+		// Old articles mark inline formulas inside the TeX itself; a
+		// display formula is the only content of its paragraph, which
+		// it replaces.
+		inline := s.HasClass("inline") || strings.Contains(tex, "$inline$")
+		tex = strings.TrimSpace(strings.ReplaceAll(tex, "$inline$", ""))
+		parent := s.Parent()
+		if inline || !parent.Is("p, div, center") || parent.Children().Length() != 1 || strings.TrimSpace(parent.Text()) != "" {
+			s.ReplaceWithHtml(`<code class="math">\(` + html.EscapeString(tex) + `\)</code>`)
+		} else {
+			parent.ReplaceWithHtml(`<pre class="math"><code>\[` + html.EscapeString(tex) + `\]</code></pre>`)
+		}
+		replaced++
+	})
+	return replaced
+}
@@ -0,0 +1,236 @@
+package habrdl
+
+import (
+	"encoding/json"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/gofrs/uuid"
+)
+
+// jsonLDObjects decodes every JSON-LD block of the page. Blocks holding an
+// array are flattened; malformed blocks are skipped.
+func jsonLDObjects(page *goquery.Document) []map[string]interface{} {
+	var objects []map[string]interface{}
+	page.Find(`script[type="application/ld+json"]`).Each(func(i int, s *goquery.Selection) {
+		raw := []byte(s.Text())
+		var obj map[string]interface{}
+		if err := json.Unmarshal(raw, &obj); err == nil {
+			objects = append(objects, obj)
+			return
+		}
+		var list []map[string]interface{}
+		if err := json.Unmarshal(raw, &list); err == nil {
+			objects = append(objects, list...)
+		}
+	})
+	return objects
+}
+
+// jsonLDName extracts a name from a JSON-LD value that may be a plain
+// string, an object with a "name" field, or a list of either.
+func jsonLDName(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case map[string]interface{}:
+		return jsonLDName(v["name"])
+	case []interface{}:
+		for _, item := range v {
+			if name := jsonLDName(item); name != "" {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// extractAuthor returns the article author's username from the raw Habr
+// page, or an empty string if none is found.
+func extractAuthor(page *goquery.Document) string {
+	if name := strings.TrimSpace(page.Find("a.tm-user-info__username").First().Text()); name != "" {
+		return name
+	}
+	if name, ok := page.Find(`meta[name="author"]`).Attr("content"); ok && strings.TrimSpace(name) != "" {
+		return strings.TrimSpace(name)
+	}
+	for _, obj := range jsonLDObjects(page) {
+		if name := jsonLDName(obj["author"]); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// extractCoverURL returns the absolute URL of the page's Open Graph image,
+// or nil if there is none.
+func extractCoverURL(page *goquery.Document, base *url.URL) *url.URL {
+	for _, sel := range []string{`meta[property="og:image"]`, `meta[name="twitter:image"]`} {
+		content := strings.TrimSpace(page.Find(sel).First().AttrOr("content", ""))
+		if content == "" {
+			continue
+		}
+		if u, err := base.Parse(content); err == nil {
+			return u
+		}
+	}
+	return nil
+}
+
+// extractPublishedDate returns the article publication time from the raw
+// page, formatted for dc:date, or an empty string if none is found.
+func extractPublishedDate(page *goquery.Document) string {
+	var candidates []string
+	for _, obj := range jsonLDObjects(page) {
+		if v, ok := obj["datePublished"].(string); ok {
+			candidates = append(candidates, v)
+		}
+	}
+	page.Find("time[datetime]").Each(func(i int, s *goquery.Selection) {
+		v, _ := s.Attr("datetime")
+		candidates = append(candidates, v)
+	})
+	for _, c := range candidates {
+		if t, err := time.Parse(time.RFC3339, strings.TrimSpace(c)); err == nil {
+			return t.UTC().Format("2006-01-02T15:04:05Z")
+		}
+	}
+	return ""
+}
+
+// extractDescription returns the article summary from the page's meta
+// description, Open Graph description or JSON-LD, or an empty string.
+func extractDescription(page *goquery.Document) string {
+	for _, sel := range []string{`meta[name="description"]`, `meta[property="og:description"]`} {
+		if content := strings.TrimSpace(page.Find(sel).First().AttrOr("content", "")); content != "" {
+			return content
+		}
+	}
+	for _, obj := range jsonLDObjects(page) {
+		if v, ok := obj["description"].(string); ok && strings.TrimSpace(v) != "" {
+			return strings.TrimSpace(v)
+		}
+	}
+	return ""
+}
+
+// urlLocalePattern matches the locale segment Habr puts first in article paths.
+var urlLocalePattern = regexp.MustCompile(`^/([a-z]{2})/`)
+
+// detectLanguage guesses the article language from the page's <html lang>
+// attribute, then from the locale segment of u, falling back to Russian.
+func detectLanguage(page *goquery.Document, u *url.URL) string {
+	if lang := strings.TrimSpace(page.Find("html").AttrOr("lang", "")); lang != "" {
+		return strings.ToLower(lang)
+	}
+	if m := urlLocalePattern.FindStringSubmatch(u.Path); m != nil {
+		return m[1]
+	}
+	return "ru"
+}
+
+// membersOnlySelector matches the notice Habr shows in place of the text of
+// an article that only registered or subscribed readers may see.
+const membersOnlySelector = ".tm-article-body__registered-only, .tm-article-presenter__paywall, .tm-paywall"
+
+// membersOnly reports whether page is the teaser of a members-only
+// article rather than the article itself.
+func membersOnly(page *goquery.Document) bool {
+	return page.Find(membersOnlySelector).Length() > 0
+}
+
+// hubSelector and tagSelector match the hub and tag links of an article.
+const (
+	hubSelector = ".tm-publication-hubs__link"
+	tagSelector = ".tm-tags-list__link"
+)
+
+// extractSubjects returns the article's hubs and tags, trimmed and
+// deduplicated, in page order.
+func extractSubjects(page *goquery.Document) []string {
+	return extractNames(page, hubSelector+", "+tagSelector)
+}
+
+// extractNames returns the text of the links matched by selector, trimmed
+// and deduplicated, in page order.
+func extractNames(page *goquery.Document, selector string) []string {
+	seen := make(map[string]bool)
+	var subjects []string
+	page.Find(selector).Each(func(i int, s *goquery.Selection) {
+		// Hub links mark private ones with a trailing asterisk.
+		name := strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(s.Text()), "*"))
+		key := strings.ToLower(name)
+		if name == "" || seen[key] {
+			return
+		}
+		seen[key] = true
+		subjects = append(subjects, name)
+	})
+	return subjects
+}
+
+// extractRating returns the article score shown on the page and whether
+// the page shows one.
+func extractRating(page *goquery.Document) (int, bool) {
+	score := page.Find(".tm-votes-meter__value, .tm-votes-lever__score-counter").First()
+	if score.Length() == 0 {
+		return 0, false
+	}
+	return parseRating(score.Text()), true
+}
+
+// articleIDPattern extracts the numeric article ID from an article path.
+var articleIDPattern = regexp.MustCompile(`/(\d+)/?$`)
+
+// articleID returns the numeric Habr article ID of u, or an empty string.
+func articleID(u *url.URL) string {
+	if m := articleIDPattern.FindStringSubmatch(u.Path); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// bookIdentifier derives a stable EPUB identifier for the article at u,
+// so that downloading it again yields the same book for library managers:
+// urn:habr:<id>, or a name-based UUID of the URL for pages without an
+// article ID. Series books get an identifier of their own.
+func bookIdentifier(u *url.URL, series bool) string {
+	suffix := ""
+	if series {
+		suffix = ":series"
+	}
+	if id := articleID(u); id != "" {
+		return "urn:habr:" + id + suffix
+	}
+	canonical := *u
+	canonical.RawQuery, canonical.Fragment = "", ""
+	canonical.Path = strings.TrimSuffix(canonical.Path, "/")
+	return "urn:uuid:" + uuid.NewV5(uuid.NamespaceURL, canonical.String()+suffix).String()
+}
+
+// anthologyIdentifier derives a stable identifier for a book compiled from
+// parts: a name-based UUID of their URLs, in order.
+func anthologyIdentifier(parts []*part) string {
+	keys := make([]string, len(parts))
+	for i, p := range parts {
+		keys[i] = seriesKey(p.url)
+	}
+	return "urn:uuid:" + uuid.NewV5(uuid.NamespaceURL, strings.Join(keys, " ")).String()
+}
+
+// bookAuthor returns the authors of parts, deduplicated in order and
+// joined with commas.
+func bookAuthor(parts []*part) string {
+	seen := make(map[string]bool)
+	var authors []string
+	for _, p := range parts {
+		if !seen[p.author] {
+			seen[p.author] = true
+			authors = append(authors, p.author)
+		}
+	}
+	return strings.Join(authors, ", ")
+}
@@ -0,0 +1,88 @@
+package habrdl
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+
+	"github.com/bmaupin/go-epub"
+)
+
+// dcElement renders a Dublin Core element such as <dc:subject> with value escaped.
+func dcElement(name, value string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(value))
+	return "<dc:" + name + ">" + buf.String() + "</dc:" + name + ">"
+}
+
+// opfPath is where go-epub stores the package document inside the archive.
+const opfPath = "EPUB/package.opf"
+
+// writeEPUB writes the book to w. go-epub has no API for some Dublin
+// Core fields, so extraMeta elements (e.g. "<dc:date>...</dc:date>") are
+// injected into the package document's <metadata> block after rendering.
+// Likewise marks are added to the navigation document as its landmarks.
+func writeEPUB(w io.Writer, e *epub.Epub, extraMeta []string, marks []landmark) (int64, error) {
+	if len(extraMeta) == 0 && len(marks) == 0 {
+		return e.WriteTo(w)
+	}
+
+	var buf bytes.Buffer
+	if _, err := e.WriteTo(&buf); err != nil {
+		return 0, err
+	}
+	patched, err := patchEPUB(buf.Bytes(), extraMeta, marks)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(patched)
+	return int64(n), err
+}
+
+// patchEPUB rewrites the EPUB archive in data, appending elements to the
+// <metadata> block of the package document and the landmarks navigation
+// for marks to the navigation document. All other entries are copied
+// unchanged, keeping the uncompressed mimetype entry first.
+func patchEPUB(data []byte, elements []string, marks []landmark) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	zw := zip.NewWriter(&out)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		if f.Name == opfPath && len(elements) > 0 {
+			meta := strings.Join(elements, "\n    ")
+			content = bytes.Replace(content, []byte("</metadata>"), []byte("  "+meta+"\n  </metadata>"), 1)
+		}
+		if f.Name == navPath && len(marks) > 0 {
+			content = bytes.Replace(content, []byte("</body>"), []byte(landmarksNav(marks)+"\n</body>"), 1)
+		}
+
+		header := &zip.FileHeader{Name: f.Name, Method: f.Method}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
@@ -0,0 +1,70 @@
+package habrdl
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"regexp"
+	"testing"
+)
+
+var opfIdentifierPattern = regexp.MustCompile(`<dc:identifier[^>]*>([^<]*)</dc:identifier>`)
+
+// opfIdentifier returns the dc:identifier of the EPUB book b.
+func opfIdentifier(t *testing.T, b *Book) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := b.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range zr.File {
+		if f.Name != "EPUB/package.opf" {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		opf, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := opfIdentifierPattern.FindSubmatch(opf)
+		if m == nil {
+			t.Fatalf("package.opf has no dc:identifier:\n%s", opf)
+		}
+		return string(m[1])
+	}
+	t.Fatal("the EPUB has no EPUB/package.opf")
+	return ""
+}
+
+func TestStableIdentifier(t *testing.T) {
+	articleURL := serveArticle(t, "100", "testdata/table_article.html")
+
+	first := opfIdentifier(t, convertFixture(t, articleURL, "epub"))
+	second := opfIdentifier(t, convertFixture(t, articleURL, "epub"))
+	if first != "urn:habr:100" {
+		t.Errorf("dc:identifier = %q, want urn:habr:100", first)
+	}
+	if first != second {
+		t.Errorf("dc:identifier changed between runs: %q, then %q", first, second)
+	}
+
+	opts := Options{Fetcher: NewFetcher(nil), AllowAnyHost: true, RandomIdentifier: true}
+	opts.Fetcher.Retries = 0
+	random, err := Convert(context.Background(), articleURL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer random.Close()
+	if id := opfIdentifier(t, random); id == first {
+		t.Errorf("RandomIdentifier kept the stable identifier %q", id)
+	}
+}
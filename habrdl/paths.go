@@ -0,0 +1,180 @@
+package habrdl
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// sanitizeFileName creates a safe file name from the article title.
+// It replaces characters that are illegal on most file systems, collapses
+// runs of whitespace into a single space replacement and guards against
+// names Windows rejects. With the default "_" replacement underscores
+// collapse together with the spaces; " " keeps the spaces as they are.
+func sanitizeFileName(name, space string) string {
+	if space == "" {
+		space = "_"
+	}
+	name = strings.TrimSpace(name)
+	// Characters not allowed in Windows filenames and also problematic on Unix.
+	illegal := regexp.MustCompile(`[<>:"/\\|?*\x00-\x1F]`)
+	collapse := regexp.MustCompile(`\s+`)
+	if space == "_" {
+		name = illegal.ReplaceAllString(name, "_")
+		// Collapse multiple spaces or underscores into a single underscore.
+		collapse = regexp.MustCompile(`[\s_]+`)
+	} else {
+		name = illegal.ReplaceAllString(name, " ")
+	}
+	name = collapse.ReplaceAllString(strings.TrimSpace(name), space)
+	// Windows silently strips trailing dots and spaces.
+	name = strings.TrimRight(name, ". ")
+	// Reserved device names cannot be used even with an extension.
+	if windowsReserved.MatchString(name) {
+		name = "_" + name
+	}
+	return name
+}
+
+// windowsReserved matches the device names Windows refuses as file names.
+var windowsReserved = regexp.MustCompile(`(?i)^(con|prn|aux|nul|com[1-9]|lpt[1-9])$`)
+
+// habrHosts lists the hosts that serve Habr articles.
+var habrHosts = map[string]bool{
+	"habr.com":     true,
+	"www.habr.com": true,
+	"m.habr.com":   true,
+	"habr.ru":      true,
+}
+
+// articlePathPattern matches article paths such as /ru/articles/123456/,
+// /en/companies/acme/articles/123456/ and the legacy /post/123456/.
+var articlePathPattern = regexp.MustCompile(`^(/[a-z]{2})?(/compan(y|ies)/[^/]+(/blog)?)?/(articles|post|news|blog)/\d+/?$`)
+
+// validateArticleURL checks that u points at a Habr article. With
+// allowAnyHost only the scheme and path are checked, so mirrors work.
+func validateArticleURL(u *url.URL, allowAnyHost bool) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if !allowAnyHost && !habrHosts[strings.ToLower(u.Hostname())] {
+		return fmt.Errorf("%s is not a Habr host (use -allow-any-host for mirrors)", u.Hostname())
+	}
+	if !articlePathPattern.MatchString(u.Path) {
+		return fmt.Errorf("%s does not look like a Habr article path", u.Path)
+	}
+	return nil
+}
+
+// renderFileName fills in the placeholders of an output name template:
+// {title}, {author}, {date} (YYYY-MM-DD) and {id}. Placeholders of unknown
+// values become empty, and the separators they leave at either end are
+// trimmed. An empty template means "{title}".
+func renderFileName(template string, b *Book) string {
+	if template == "" {
+		template = "{title}"
+	}
+	date := b.Published
+	if len(date) > len("2006-01-02") {
+		date = date[:len("2006-01-02")]
+	}
+	name := strings.NewReplacer(
+		"{title}", b.Title,
+		"{author}", b.Author,
+		"{date}", date,
+		"{id}", b.ID,
+	).Replace(template)
+	return strings.Trim(name, " _-.")
+}
+
+// outputName returns the file name, without extension, for book b: the
+// rendered NameTemplate passed through sanitizeFileName. Names that end up
+// empty or made only of separators, e.g. from an all-punctuation title,
+// fall back to the article ID, then to "article".
+func outputName(b *Book, opts *Options) string {
+	name := sanitizeFileName(renderFileName(opts.NameTemplate, b), opts.SpaceReplacement)
+	if strings.Trim(name, "_-. ") != "" {
+		return name
+	}
+	if b.ID != "" {
+		return b.ID
+	}
+	return "article"
+}
+
+// OutputExt returns the file extension of books in format, such as
+// ".fb2"; kepub EPUBs get the double ".kepub.epub" extension.
+func OutputExt(format string, kepub bool) string {
+	if format == "epub" && kepub {
+		return ".kepub.epub"
+	}
+	return "." + format
+}
+
+// hasOutputExt reports whether out names a file with extension ext, which
+// may span several dots like ".kepub.epub", ignoring case.
+func hasOutputExt(out, ext string) bool {
+	return strings.HasSuffix(strings.ToLower(out), strings.ToLower(ext))
+}
+
+// PrepareOutputDir checks, before anything is downloaded, that the
+// directory out resolves to (see resolveOutputPath) exists and is
+// writable. ext is the extension of the book, as OutputExt returns it. A
+// missing directory is created when out ends in a separator or create is
+// set, and is an error otherwise.
+func PrepareOutputDir(out, ext string, create bool) error {
+	dir := out
+	trailing := strings.HasSuffix(out, "/") || strings.HasSuffix(out, string(os.PathSeparator))
+	if info, err := os.Stat(out); !trailing && (err != nil || !info.IsDir()) && hasOutputExt(out, ext) {
+		dir = filepath.Dir(out)
+	}
+
+	info, err := os.Stat(dir)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && (trailing || create):
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("output directory %s does not exist (use -mkdir to create it)", dir)
+	case err != nil:
+		return fmt.Errorf("cannot use output directory: %w", err)
+	case !info.IsDir():
+		return fmt.Errorf("output path %s is not a directory", dir)
+	}
+
+	// Permission bits do not tell the whole story (read-only mounts, ACLs),
+	// so try to write a file.
+	probe, err := os.CreateTemp(dir, ".habrdownloader-*")
+	if err != nil {
+		return fmt.Errorf("output directory %s is not writable: %w", dir, err)
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// resolveOutputPath computes where the book is written. out may name a
+// file (when it carries the expected extension) or a directory; existing
+// directories and paths ending in a separator receive name+ext.
+// A trailing separator also creates the directory if it does not exist yet.
+func resolveOutputPath(out, name, ext string) (string, error) {
+	fileName := name + ext
+	if strings.HasSuffix(out, "/") || strings.HasSuffix(out, string(os.PathSeparator)) {
+		if err := os.MkdirAll(out, 0o755); err != nil {
+			return "", err
+		}
+		return filepath.Join(out, fileName), nil
+	}
+	if info, err := os.Stat(out); err == nil && info.IsDir() {
+		return filepath.Join(out, fileName), nil
+	}
+	if hasOutputExt(out, ext) {
+		return out, nil
+	}
+	return filepath.Join(out, fileName), nil
+}
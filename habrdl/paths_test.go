@@ -0,0 +1,213 @@
+package habrdl
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveOutputPath(t *testing.T) {
+	root := t.TempDir()
+	existing := filepath.Join(root, "books")
+	if err := os.Mkdir(existing, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	sep := string(os.PathSeparator)
+
+	tests := []struct {
+		name    string
+		out     string
+		ext     string
+		want    string
+		wantDir string // created by the call, if set
+	}{
+		{"file path", filepath.Join(root, "book.epub"), ".epub", filepath.Join(root, "book.epub"), ""},
+		{"file path with upper-case extension", filepath.Join(root, "BOOK.EPUB"), ".epub", filepath.Join(root, "BOOK.EPUB"), ""},
+		{"existing directory", existing, ".epub", filepath.Join(existing, "Title.epub"), ""},
+		{"existing directory, other format", existing, ".fb2", filepath.Join(existing, "Title.fb2"), ""},
+		{"trailing separator", filepath.Join(root, "new") + sep, ".epub", filepath.Join(root, "new", "Title.epub"), filepath.Join(root, "new")},
+		{"trailing slash", filepath.Join(root, "slash") + "/", ".fb2", filepath.Join(root, "slash", "Title.fb2"), filepath.Join(root, "slash")},
+		{"other extension", filepath.Join(root, "book.fb2"), ".epub", filepath.Join(root, "book.fb2", "Title.epub"), ""},
+		{"kepub file path", filepath.Join(root, "book.kepub.epub"), ".kepub.epub", filepath.Join(root, "book.kepub.epub"), ""},
+		{"kepub into directory", existing, ".kepub.epub", filepath.Join(existing, "Title.kepub.epub"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveOutputPath(tt.out, "Title", tt.ext)
+			if err != nil {
+				t.Fatalf("resolveOutputPath(%q) failed: %v", tt.out, err)
+			}
+			if got != tt.want {
+				t.Errorf("resolveOutputPath(%q) = %q, want %q", tt.out, got, tt.want)
+			}
+			if tt.wantDir != "" {
+				if info, err := os.Stat(tt.wantDir); err != nil || !info.IsDir() {
+					t.Errorf("directory %s was not created: %v", tt.wantDir, err)
+				}
+			}
+		})
+	}
+}
+
+func TestOutputExt(t *testing.T) {
+	tests := []struct {
+		format string
+		kepub  bool
+		want   string
+	}{
+		{"epub", false, ".epub"},
+		{"epub", true, ".kepub.epub"},
+		{"fb2", true, ".fb2"},
+		{"md", false, ".md"},
+	}
+	for _, tt := range tests {
+		if got := OutputExt(tt.format, tt.kepub); got != tt.want {
+			t.Errorf("OutputExt(%q, %v) = %q, want %q", tt.format, tt.kepub, got, tt.want)
+		}
+	}
+}
+
+func TestPrepareOutputDir(t *testing.T) {
+	root := t.TempDir()
+	sep := string(os.PathSeparator)
+
+	tests := []struct {
+		name    string
+		out     string
+		ext     string
+		create  bool
+		wantErr bool
+		wantDir string // must exist afterwards, if set
+	}{
+		{"file in existing directory", filepath.Join(root, "book.epub"), ".epub", false, false, root},
+		{"file in missing directory", filepath.Join(root, "missing", "book.epub"), ".epub", false, true, ""},
+		{"file in missing directory with create", filepath.Join(root, "created", "book.epub"), ".epub", true, false, filepath.Join(root, "created")},
+		{"existing directory", root, ".epub", false, false, root},
+		{"kepub file in existing directory", filepath.Join(root, "book.kepub.epub"), ".kepub.epub", false, false, root},
+		{"kepub file in missing directory", filepath.Join(root, "gone", "book.kepub.epub"), ".kepub.epub", false, true, ""},
+		{"missing directory", filepath.Join(root, "absent"), ".epub", false, true, ""},
+		{"trailing separator", filepath.Join(root, "trailing") + sep, ".epub", false, false, filepath.Join(root, "trailing")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := PrepareOutputDir(tt.out, tt.ext, tt.create)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PrepareOutputDir(%q) error = %v, want error %v", tt.out, err, tt.wantErr)
+			}
+			if tt.wantDir != "" {
+				if info, err := os.Stat(tt.wantDir); err != nil || !info.IsDir() {
+					t.Errorf("directory %s does not exist: %v", tt.wantDir, err)
+				}
+			}
+		})
+	}
+
+	t.Run("regular file as directory", func(t *testing.T) {
+		file := filepath.Join(root, "plain")
+		if err := os.WriteFile(file, nil, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := PrepareOutputDir(file, ".epub", false); err == nil {
+			t.Errorf("PrepareOutputDir(%q) accepted a regular file as directory", file)
+		}
+	})
+}
+
+func TestValidateArticleURL(t *testing.T) {
+	tests := []struct {
+		url          string
+		allowAnyHost bool
+		ok           bool
+	}{
+		{"https://habr.com/ru/articles/123456/", false, true},
+		{"https://habr.com/en/articles/123456", false, true},
+		{"https://habr.com/ru/companies/acme/articles/123456/", false, true},
+		{"https://habr.com/ru/company/acme/blog/123456/", false, true},
+		{"https://habr.com/post/123456/", false, true},
+		{"https://m.habr.com/ru/post/123456/", false, true},
+		{"http://habr.ru/post/123456/", false, true},
+		{"https://habr.com/ru/news/123456/", false, true},
+		{"https://evilhabr.com/ru/articles/123456/", false, false},
+		{"https://habr.com.evil.example/ru/articles/123456/", false, false},
+		{"https://habr.com/ru/articles/", false, false},
+		{"https://habr.com/ru/users/someone/", false, false},
+		{"https://habr.com/ru/articles/12ab/", false, false},
+		{"ftp://habr.com/ru/articles/123456/", false, false},
+		{"https://mirror.example/ru/articles/123456/", false, false},
+		{"https://mirror.example/ru/articles/123456/", true, true},
+		{"https://mirror.example/about/", true, false},
+		{"file:///ru/articles/123456/", true, false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = validateArticleURL(u, tt.allowAnyHost)
+		if (err == nil) != tt.ok {
+			t.Errorf("validateArticleURL(%q, %v) = %v, want ok %v", tt.url, tt.allowAnyHost, err, tt.ok)
+		}
+	}
+}
+
+func TestSanitizeFileName(t *testing.T) {
+	tests := []struct {
+		name  string
+		space string
+		want  string
+	}{
+		{"Go 1.22: generics", "", "Go_1.22_generics"},
+		{"a  b__c", "_", "a_b_c"},
+		{`what/is\this?`, "_", "what_is_this_"},
+		{"CON", "", "_CON"},
+		{"con", "", "_con"},
+		{"Nul", "", "_Nul"},
+		{"PRN", "", "_PRN"},
+		{"aux", "", "_aux"},
+		{"COM1", "", "_COM1"},
+		{"lpt9", "", "_lpt9"},
+		{"COM0", "", "COM0"},
+		{"CONSOLE", "", "CONSOLE"},
+		{"CON.", "", "_CON"},
+		{"  CON  ", "", "_CON"},
+		{"Заголовок...", "", "Заголовок"},
+		{"trailing dots. . .", " ", "trailing dots"},
+		{"title ends with space ", "-", "title-ends-with-space"},
+		{"Go 1.22: generics", " ", "Go 1.22 generics"},
+		{"Go 1.22: generics", "-", "Go-1.22-generics"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFileName(tt.name, tt.space); got != tt.want {
+			t.Errorf("sanitizeFileName(%q, %q) = %q, want %q", tt.name, tt.space, got, tt.want)
+		}
+	}
+}
+
+func TestOutputNameFallbacks(t *testing.T) {
+	tests := []struct {
+		name  string
+		title string
+		id    string
+		space string
+		want  string
+	}{
+		{"regular title", "Go generics", "123", "", "Go_generics"},
+		{"empty title", "", "123456", "", "123456"},
+		{"empty title without ID", "", "", "", "article"},
+		{"whitespace title", "   ", "123456", "", "123456"},
+		{"all-punctuation title", `?:*"<>|/`, "123456", "", "123456"},
+		{"all-punctuation title without ID", "...?", "", "", "article"},
+		{"all-punctuation title, dash replacement", "?? -- ??", "42", "-", "42"},
+		{"all-punctuation title, space replacement", "/ / /", "", " ", "article"},
+		{"reserved name stays usable", "CON", "1", "", "_CON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &Book{Title: tt.title, ID: tt.id}
+			if got := outputName(b, &Options{SpaceReplacement: tt.space}); got != tt.want {
+				t.Errorf("outputName(%q) = %q, want %q", tt.title, got, tt.want)
+			}
+		})
+	}
+}
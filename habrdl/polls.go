@@ -0,0 +1,126 @@
+package habrdl
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Selectors for the parts of a Habr poll. Most of the widget is script,
+// but the page carries the question, the answers and the results.
+const (
+	pollSelector         = ".tm-poll"
+	pollQuestionSelector = ".tm-poll__header, .tm-poll__title"
+	pollAnswerSelector   = ".tm-poll-answer, .tm-poll-result"
+	pollTextSelector     = ".tm-poll-answer__text, .tm-poll-result__text"
+	pollPercentSelector  = ".tm-poll-answer__percent, .tm-poll-result__percent"
+	pollVotesSelector    = ".tm-poll-answer__votes, .tm-poll-result__votes"
+	pollTotalSelector    = ".tm-poll__votes, .tm-poll__footer"
+)
+
+// poll is a poll of an article with its results.
+type poll struct {
+	question string
+	answers  []pollAnswer
+	// votes is the number of voters, 0 when unknown.
+	votes int
+}
+
+// pollAnswer is one answer of a poll. votes is -1 and percent -1 when the
+// page does not show them.
+type pollAnswer struct {
+	text    string
+	votes   int
+	percent float64
+}
+
+// extractPolls removes the poll widgets from page and returns their
+// content. Polls sit below the article text, where readability drops them.
+func extractPolls(page *goquery.Document) []poll {
+	var polls []poll
+	page.Find(pollSelector).Each(func(i int, s *goquery.Selection) {
+		p := poll{question: strings.TrimSpace(s.Find(pollQuestionSelector).First().Text())}
+		s.Find(pollAnswerSelector).Each(func(j int, a *goquery.Selection) {
+			text := strings.TrimSpace(a.Find(pollTextSelector).First().Text())
+			if text == "" {
+				text = strings.TrimSpace(whitespacePattern.ReplaceAllString(a.Text(), " "))
+			}
+			if text == "" {
+				return
+			}
+			answer := pollAnswer{text: text, votes: -1, percent: -1}
+			if v, err := strconv.Atoi(digits(a.Find(pollVotesSelector).First().Text())); err == nil {
+				answer.votes = v
+			}
+			percent := strings.TrimSuffix(strings.TrimSpace(a.Find(pollPercentSelector).First().Text()), "%")
+			if v, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(percent), ",", "."), 64); err == nil {
+				answer.percent = v
+			}
+			p.answers = append(p.answers, answer)
+		})
+		if v, err := strconv.Atoi(digits(s.Find(pollTotalSelector).First().Text())); err == nil {
+			p.votes = v
+		}
+		if p.question != "" || len(p.answers) > 0 {
+			polls = append(polls, p)
+		}
+	})
+	page.Find(pollSelector).Remove()
+	return polls
+}
+
+// digits returns the decimal digits of s, dropping group separators and
+// words such as "votes".
+func digits(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if r >= '0' && r <= '9' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// pollsHTML renders polls as static tables of their answers and results.
+func pollsHTML(polls []poll) string {
+	var buf bytes.Buffer
+	for _, p := range polls {
+		buf.WriteString(`<div class="poll">`)
+		if p.question != "" {
+			buf.WriteString(`<p class="poll-question"><strong>` + html.EscapeString(p.question) + "</strong></p>")
+		}
+		// Answers with votes but no percentage get one from the total.
+		total := p.votes
+		if total == 0 {
+			for _, a := range p.answers {
+				if a.votes > 0 {
+					total += a.votes
+				}
+			}
+		}
+		buf.WriteString("<table><tr><th>Answer</th><th>Votes</th><th>%</th></tr>")
+		for _, a := range p.answers {
+			votes, percent := "", ""
+			if a.votes >= 0 {
+				votes = strconv.Itoa(a.votes)
+			}
+			if a.percent < 0 && a.votes >= 0 && total > 0 {
+				a.percent = float64(a.votes) * 100 / float64(total)
+			}
+			if a.percent >= 0 {
+				percent = strings.TrimSuffix(fmt.Sprintf("%.1f", a.percent), ".0")
+			}
+			buf.WriteString("<tr><td>" + html.EscapeString(a.text) + "</td><td>" + votes + "</td><td>" + percent + "</td></tr>")
+		}
+		buf.WriteString("</table>")
+		if p.votes > 0 {
+			fmt.Fprintf(&buf, `<p class="poll-total">%s voted</p>`, groupThousands(p.votes))
+		}
+		buf.WriteString("</div>")
+	}
+	return buf.String()
+}
@@ -0,0 +1,233 @@
+package habrdl
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// seriesSelectors lists the blocks Habr uses to navigate between the parts
+// of an article series.
+var seriesSelectors = []string{
+	".tm-article-series",
+	".tm-series-navigation",
+	".series-navigation",
+}
+
+// seriesPartPattern matches link texts such as "Часть 2" or "Part 3" that
+// point at sibling parts when no dedicated navigation block is present.
+var seriesPartPattern = regexp.MustCompile(`(?i)(часть|part)\s*\d+`)
+
+// seriesTitlePattern splits titles such as "Пишем компилятор. Часть 2"
+// or "Go generics (part 3)" into the series name and the part number.
+var seriesTitlePattern = regexp.MustCompile(`(?i)^(.*?)[\s.,:;(\[—–-]*(?:часть|part)\s*(\d+)`)
+
+// maxSeriesListingPages bounds how much of the author's article list is
+// searched for parts of a series that has no links between its parts.
+const maxSeriesListingPages = 5
+
+// seriesTitle returns the normalized series name and the part number of
+// title, or ok=false when the title does not name a part.
+func seriesTitle(title string) (name string, number int, ok bool) {
+	m := seriesTitlePattern.FindStringSubmatch(title)
+	if m == nil {
+		return "", 0, false
+	}
+	number, err := strconv.Atoi(m[2])
+	name = strings.ToLower(strings.Join(strings.Fields(m[1]), " "))
+	if err != nil || name == "" {
+		return "", 0, false
+	}
+	return name, number, true
+}
+
+// seriesLink is a single entry of a series navigation block.
+type seriesLink struct {
+	Title string
+	URL   string
+}
+
+// extractSeriesLinks collects links to the other parts of the series the
+// article belongs to. Relative links are resolved against base and the
+// article itself is excluded.
+func extractSeriesLinks(page *goquery.Document, base *url.URL) []seriesLink {
+	var links []seriesLink
+	seen := map[string]bool{base.String(): true}
+
+	add := func(s *goquery.Selection) {
+		href, ok := s.Attr("href")
+		if !ok || strings.HasPrefix(href, "#") {
+			return
+		}
+		u, err := base.Parse(strings.TrimSpace(href))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return
+		}
+		u.Fragment = ""
+		if seen[u.String()] {
+			return
+		}
+		seen[u.String()] = true
+		title := strings.TrimSpace(s.Text())
+		if title == "" {
+			title = u.String()
+		}
+		links = append(links, seriesLink{Title: title, URL: u.String()})
+	}
+
+	for _, sel := range seriesSelectors {
+		page.Find(sel).Find("a[href]").Each(func(i int, s *goquery.Selection) {
+			add(s)
+		})
+	}
+	if len(links) > 0 {
+		return links
+	}
+
+	// Fallback: "Part N" links inside the article body.
+	page.Find(".tm-article-body a[href], #post-content-body a[href]").Each(func(i int, s *goquery.Selection) {
+		if seriesPartPattern.MatchString(s.Text()) {
+			add(s)
+		}
+	})
+	return links
+}
+
+// seriesLinksHTML renders the series links as a heading and a list.
+func seriesLinksHTML(links []seriesLink) string {
+	var buf bytes.Buffer
+	buf.WriteString("<h2>Other parts in this series</h2><ul>")
+	for _, l := range links {
+		fmt.Fprintf(&buf, "<li><a href=\"%s\">%s</a></li>", html.EscapeString(l.URL), html.EscapeString(l.Title))
+	}
+	buf.WriteString("</ul>")
+	return buf.String()
+}
+
+// maxSeriesParts bounds how many articles a series book may collect.
+const maxSeriesParts = 50
+
+// seriesKey identifies an article independently of host and trailing
+// slash, so the same part reached through different links is fetched once.
+func seriesKey(u *url.URL) string {
+	if id := articleID(u); id != "" {
+		return id
+	}
+	return u.String()
+}
+
+// collectSeries fetches every part reachable through the series links of
+// first, following the links of each new part in turn. Without links, a
+// title like "… Часть 2" makes it look for the other parts by title in
+// the author's article list. Parts that fail to download are skipped with
+// a warning. The parts are returned in the order of the part numbers in
+// their titles, or else by article ID, which follows publication order;
+// first alone is returned when no other part is found.
+func collectSeries(ctx context.Context, first *part, opts *Options) []*part {
+	parts := []*part{first}
+	visited := map[string]bool{seriesKey(first.url): true}
+	queue := seriesPartURLs(first, opts)
+	if len(queue) == 0 {
+		queue = seriesTitleURLs(ctx, first, opts)
+	}
+	for len(queue) > 0 && len(parts) < maxSeriesParts {
+		u := queue[0]
+		queue = queue[1:]
+		if visited[seriesKey(u)] {
+			continue
+		}
+		visited[seriesKey(u)] = true
+
+		p, err := fetchPart(ctx, u.String(), opts)
+		if err != nil {
+			opts.logf("warning: skipped series part %s: %v", u, err)
+			continue
+		}
+		parts = append(parts, p)
+		queue = append(queue, seriesPartURLs(p, opts)...)
+	}
+
+	if numbers, ok := partNumbers(parts); ok {
+		sort.SliceStable(parts, func(i, j int) bool { return numbers[parts[i]] < numbers[parts[j]] })
+		return parts
+	}
+	sort.SliceStable(parts, func(i, j int) bool {
+		a, _ := strconv.Atoi(articleID(parts[i].url))
+		b, _ := strconv.Atoi(articleID(parts[j].url))
+		return a < b
+	})
+	return parts
+}
+
+// partNumbers returns the part number of every part, from its title, or
+// ok=false unless all parts carry distinct numbers.
+func partNumbers(parts []*part) (map[*part]int, bool) {
+	numbers := make(map[*part]int)
+	used := make(map[int]bool)
+	for _, p := range parts {
+		_, n, ok := seriesTitle(p.title)
+		if !ok || used[n] {
+			return nil, false
+		}
+		used[n] = true
+		numbers[p] = n
+	}
+	return numbers, true
+}
+
+// seriesTitleURLs searches the author's article list, linked from the
+// page of p, for other parts of the series named in the title of p.
+func seriesTitleURLs(ctx context.Context, p *part, opts *Options) []*url.URL {
+	name, _, ok := seriesTitle(p.title)
+	if !ok {
+		return nil
+	}
+	href, ok := p.page.Find("a.tm-user-info__username").First().Attr("href")
+	if !ok {
+		return nil
+	}
+	profile, err := p.url.Parse(href)
+	if err != nil {
+		return nil
+	}
+	listURL, _ := profile.Parse(strings.TrimSuffix(profile.Path, "/") + "/articles/")
+	opts.debugf("looking for other parts of %q at %s", name, listURL)
+	articles, err := listArticles(ctx, opts.Fetcher, listURL.String(), time.Time{}, 0, maxSeriesListingPages)
+	if err != nil {
+		opts.debugf("failed to list the author's articles: %v", err)
+		return nil
+	}
+
+	var urls []*url.URL
+	for _, a := range articles {
+		if other, _, ok := seriesTitle(a.Title); !ok || other != name {
+			continue
+		}
+		if u, err := url.Parse(a.URL); err == nil && validateArticleURL(u, opts.AllowAnyHost) == nil {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// seriesPartURLs returns the series links of p that point at articles.
+func seriesPartURLs(p *part, opts *Options) []*url.URL {
+	var urls []*url.URL
+	for _, link := range extractSeriesLinks(p.page, p.url) {
+		u, err := url.Parse(link.URL)
+		if err != nil || validateArticleURL(u, opts.AllowAnyHost) != nil {
+			continue
+		}
+		urls = append(urls, u)
+	}
+	return urls
+}
@@ -0,0 +1,64 @@
+package habrdl
+
+import (
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+func TestExtractSeriesLinks(t *testing.T) {
+	f, err := os.Open("testdata/series_member.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	page, err := goquery.NewDocumentFromReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := url.Parse("https://habr.com/ru/articles/100002/")
+
+	links := extractSeriesLinks(page, base)
+	want := []seriesLink{
+		{Title: "Пишем компилятор. Часть 1", URL: "https://habr.com/ru/articles/100001/"},
+		{Title: "Пишем компилятор. Часть 3", URL: "https://habr.com/ru/articles/100003/"},
+	}
+	if len(links) != len(want) {
+		t.Fatalf("got %d links %v, want %v", len(links), links, want)
+	}
+	for i := range want {
+		if links[i] != want[i] {
+			t.Errorf("link %d = %v, want %v", i, links[i], want[i])
+		}
+	}
+
+	html := seriesLinksHTML(links)
+	for _, l := range want {
+		if !strings.Contains(html, `<a href="`+l.URL+`">`) {
+			t.Errorf("appendix %q lacks a link to %s", html, l.URL)
+		}
+	}
+}
+
+func TestSeriesTitle(t *testing.T) {
+	tests := []struct {
+		title  string
+		name   string
+		number int
+		ok     bool
+	}{
+		{"Пишем компилятор. Часть 2", "пишем компилятор", 2, true},
+		{"Go generics (part 3)", "go generics", 3, true},
+		{"Часть 1", "", 0, false},
+		{"Просто статья", "", 0, false},
+	}
+	for _, tt := range tests {
+		name, number, ok := seriesTitle(tt.title)
+		if name != tt.name || number != tt.number || ok != tt.ok {
+			t.Errorf("seriesTitle(%q) = %q, %d, %v; want %q, %d, %v", tt.title, name, number, ok, tt.name, tt.number, tt.ok)
+		}
+	}
+}
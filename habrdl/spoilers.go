@@ -0,0 +1,48 @@
+package habrdl
+
+import (
+	"html"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// spoilerSelector matches Habr's spoilers: <details class="spoiler"> in
+// current articles and the script-driven <div class="spoiler"> of older ones.
+const spoilerSelector = "details.spoiler, div.spoiler"
+
+// spoilerTitleSelector matches the title of a spoiler.
+const spoilerTitleSelector = "summary, .spoiler_title, .spoiler__title"
+
+// replaceSpoilers rewrites the spoilers of page, which Habr opens with
+// JavaScript, into markup that needs none. With mode "details" they become
+// <details> elements with the title as <summary>, which EPUB 3 readers can
+// fold; with "expand" they become boxes that are always open, titled in
+// bold. It returns the number of rewritten spoilers.
+func replaceSpoilers(page *goquery.Document, mode string) int {
+	spoilers := page.Find(spoilerSelector)
+	// Inner spoilers first, so an outer one takes them along rewritten.
+	for i := spoilers.Length() - 1; i >= 0; i-- {
+		s := spoilers.Eq(i)
+		titleSel := s.ChildrenFiltered(spoilerTitleSelector).First()
+		title := strings.TrimSpace(titleSel.Text())
+		if title == "" {
+			title = "Spoiler"
+		}
+		titleSel.Remove()
+		body := s
+		if text := s.ChildrenFiltered(".spoiler_text, .spoiler__text"); text.Length() == 1 {
+			body = text
+		}
+		content, err := body.Html()
+		if err != nil {
+			continue
+		}
+		if mode == "details" {
+			s.ReplaceWithHtml(`<details class="spoiler"><summary>` + html.EscapeString(title) + "</summary><div>" + content + "</div></details>")
+		} else {
+			s.ReplaceWithHtml(`<div class="spoiler"><p class="spoiler-title"><strong>` + html.EscapeString(title) + "</strong></p>" + content + "</div>")
+		}
+	}
+	return spoilers.Length()
+}
@@ -0,0 +1,75 @@
+package habrdl
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+)
+
+// chromeSelectors lists the Habr interface blocks that can end up inside
+// the extracted article: voting and sharing widgets, subscription prompts
+// and notices for anonymous readers.
+var chromeSelectors = []string{
+	".tm-article-sticky-panel",
+	".tm-votes-meter",
+	".tm-votes-lever",
+	".tm-sharing",
+	".tm-article-share",
+	".tm-article-poll",
+	".tm-article-subscription",
+	".tm-user-card",
+	".tm-notice",
+	".tm-adfox-banner",
+	".tm-article-snippet__readmore",
+	".tm-article-comments-counter-link",
+}
+
+// readMoreTexts are link texts of teaser links that point back at the
+// article itself.
+var readMoreTexts = map[string]bool{
+	"читать далее":  true,
+	"читать дальше": true,
+	"read more":     true,
+}
+
+// checkSelectors reports the first invalid CSS selector of selectors.
+func checkSelectors(selectors []string) error {
+	for _, sel := range selectors {
+		if _, err := cascadia.ParseGroup(sel); err != nil {
+			return fmt.Errorf("invalid selector %q: %w", sel, err)
+		}
+	}
+	return nil
+}
+
+// stripChrome returns a copy of page without the interface blocks matched
+// by chromeSelectors and extra. The copy is fed to readability, while the
+// original page keeps the blocks the metadata extractors read. It returns
+// nil when nothing matched.
+func stripChrome(page *goquery.Document, extra []string) *goquery.Document {
+	selectors := strings.Join(append(append([]string(nil), chromeSelectors...), extra...), ", ")
+	if page.Find(selectors).Length() == 0 {
+		return nil
+	}
+	clean := goquery.NewDocumentFromNode(page.Selection.Clone().Nodes[0])
+	clean.Find(selectors).Remove()
+	return clean
+}
+
+// stripReadMore removes "read more" teaser links from the extracted
+// article, whose classes readability has already dropped.
+func stripReadMore(doc *goquery.Document) {
+	doc.Find("a").Each(func(i int, s *goquery.Selection) {
+		if !readMoreTexts[strings.ToLower(strings.TrimSpace(s.Text()))] {
+			return
+		}
+		// Do not leave the paragraph that held only the link behind.
+		if parent := s.Parent(); parent.Is("p") && strings.TrimSpace(parent.Text()) == strings.TrimSpace(s.Text()) {
+			parent.Remove()
+			return
+		}
+		s.Remove()
+	})
+}
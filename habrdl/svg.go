@@ -0,0 +1,169 @@
+package habrdl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/bmaupin/go-epub"
+	"github.com/srwiley/oksvg"
+	"github.com/srwiley/rasterx"
+)
+
+// svgNamespace must be declared on inline SVG, or XHTML readers treat the
+// drawing as unknown markup.
+const svgNamespace = "http://www.w3.org/2000/svg"
+
+// svgScale renders rasterized drawings at twice their size, so they stay
+// sharp on high-density screens.
+const svgScale = 2
+
+// handleInlineSVG processes the inline <svg> drawings of doc. With mode
+// "inline" they stay in the text with their namespaces declared. With
+// "raster" (the default) each one is rendered to a PNG and embedded like
+// any other image; drawings with text stay inline, since the rasterizer
+// cannot draw text. It returns a description of every drawing that could
+// not be rasterized and was kept inline instead.
+func handleInlineSVG(doc *goquery.Document, e *epub.Epub, tmpDir string, counter *int, opts *Options) []string {
+	var failed []string
+	doc.Find("svg").Each(func(i int, s *goquery.Selection) {
+		// Nested drawings are handled with their outermost <svg>.
+		if s.ParentsFiltered("svg").Length() > 0 {
+			return
+		}
+		if opts.SVGMode == "inline" || s.Find("text").Length() > 0 {
+			declareSVGNamespaces(s)
+			return
+		}
+
+		alt := strings.TrimSpace(s.ChildrenFiltered("title").First().Text())
+		declareSVGNamespaces(s)
+		markup, err := goquery.OuterHtml(s)
+		if err == nil {
+			var data []byte
+			var width int
+			if data, width, err = rasterizeSVG(markup, s); err == nil {
+				var src string
+				if src, err = embedPNG(data, e, tmpDir, counter, opts); err == nil {
+					s.ReplaceWithHtml(fmt.Sprintf(`<img src="%s" alt="%s" width="%d"/>`, html.EscapeString(src), html.EscapeString(alt), width))
+					opts.debugf("rasterized inline SVG %d (%d bytes)", i+1, len(data))
+					return
+				}
+			}
+		}
+		failed = append(failed, fmt.Sprintf("inline SVG %d: %v", i+1, err))
+	})
+	return failed
+}
+
+// declareSVGNamespaces adds the xmlns declarations an HTML parser drops.
+func declareSVGNamespaces(s *goquery.Selection) {
+	if _, ok := s.Attr("xmlns"); !ok {
+		s.SetAttr("xmlns", svgNamespace)
+	}
+	if markup, err := goquery.OuterHtml(s); err == nil && strings.Contains(markup, "xlink:") {
+		if _, ok := s.Attr("xmlns:xlink"); !ok {
+			s.SetAttr("xmlns:xlink", "http://www.w3.org/1999/xlink")
+		}
+	}
+}
+
+// svgSize returns the drawing's size from its width and height attributes,
+// then its viewBox, falling back to 600×400.
+func svgSize(s *goquery.Selection, icon *oksvg.SvgIcon) (float64, float64) {
+	parse := func(attr string) float64 {
+		v, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s.AttrOr(attr, "")), "px"), 64)
+		if err != nil {
+			return 0
+		}
+		return v
+	}
+	w, h := parse("width"), parse("height")
+	if w > 0 && h > 0 {
+		return w, h
+	}
+	if icon.ViewBox.W > 0 && icon.ViewBox.H > 0 {
+		return icon.ViewBox.W, icon.ViewBox.H
+	}
+	return 600, 400
+}
+
+// rasterizeSVG renders an SVG document to PNG and returns it with the
+// width, in CSS pixels, it should be shown at.
+func rasterizeSVG(markup string, s *goquery.Selection) ([]byte, int, error) {
+	icon, err := oksvg.ReadIconStream(strings.NewReader(markup), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, 0, err
+	}
+	w, h := svgSize(s, icon)
+	width, height := int(w*svgScale), int(h*svgScale)
+	if width <= 0 || height <= 0 {
+		return nil, 0, fmt.Errorf("invalid size %gx%g", w, h)
+	}
+	data, err := renderSVG(icon, width, height)
+	return data, int(w), err
+}
+
+// rasterizeSVGImage renders a downloaded SVG image to a PNG width pixels
+// wide, keeping the aspect ratio of its viewBox. Drawings with text are
+// refused, since the rasterizer cannot draw text.
+func rasterizeSVGImage(data []byte, width int) ([]byte, error) {
+	if bytes.Contains(data, []byte("<text")) {
+		return nil, errors.New("the drawing contains text")
+	}
+	icon, err := oksvg.ReadIconStream(bytes.NewReader(data), oksvg.IgnoreErrorMode)
+	if err != nil {
+		return nil, err
+	}
+	if icon.ViewBox.W <= 0 || icon.ViewBox.H <= 0 {
+		return nil, errors.New("no viewBox to size the drawing by")
+	}
+	height := int(float64(width) * icon.ViewBox.H / icon.ViewBox.W)
+	if height <= 0 {
+		return nil, fmt.Errorf("invalid size %gx%g", icon.ViewBox.W, icon.ViewBox.H)
+	}
+	return renderSVG(icon, width, height)
+}
+
+// renderSVG draws icon onto a width×height PNG.
+func renderSVG(icon *oksvg.SvgIcon, width, height int) ([]byte, error) {
+	icon.SetTarget(0, 0, float64(width), float64(height))
+
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	scanner := rasterx.NewScannerGV(width, height, img, img.Bounds())
+	icon.Draw(rasterx.NewDasher(width, height, scanner), 1)
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// embedPNG stores a generated PNG in the book, or as a data: URI for the
+// html and fb2 formats or in the assets folder for md, and returns the
+// src to reference it with.
+func embedPNG(data []byte, e *epub.Epub, tmpDir string, counter *int, opts *Options) (string, error) {
+	data = shrinkImage(data, ".png", 0, 0, opts.Grayscale)
+	if opts.inlineImages() {
+		return dataURI(data, ".png"), nil
+	}
+	if opts.Format == "md" {
+		return stageAsset(tmpDir, data, ".png")
+	}
+	name := fmt.Sprintf("image_%03d.png", *counter)
+	*counter++
+	tmpPath := filepath.Join(tmpDir, name)
+	if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
+		return "", err
+	}
+	return e.AddImage(tmpPath, name)
+}
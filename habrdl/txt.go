@@ -0,0 +1,158 @@
+package habrdl
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// textBuilder strips the markup of the rendered book down to plain text:
+// paragraphs separated by blank lines, code blocks indented by four
+// spaces and lists marked with "-" or their numbers.
+type textBuilder struct {
+	blocks []string
+	line   strings.Builder
+}
+
+// flush ends the current paragraph, if it has any text.
+func (t *textBuilder) flush() {
+	var lines []string
+	for _, line := range strings.Split(t.line.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > 0 {
+		t.blocks = append(t.blocks, strings.Join(lines, "\n"))
+	}
+	t.line.Reset()
+}
+
+// html adds the text of an HTML fragment.
+func (t *textBuilder) html(fragment string) error {
+	doc, err := goquery.NewDocumentFromReader(strings.NewReader(sectionHTML(fragment)))
+	if err != nil {
+		return fmt.Errorf("failed to parse section HTML: %w", err)
+	}
+	t.children(doc.Find("body"))
+	t.flush()
+	return nil
+}
+
+// children adds the text of the child nodes of s.
+func (t *textBuilder) children(s *goquery.Selection) {
+	s.Contents().Each(func(i int, n *goquery.Selection) {
+		t.node(n)
+	})
+}
+
+// node adds the text of one node, starting a new paragraph at every block.
+func (t *textBuilder) node(n *goquery.Selection) {
+	switch goquery.NodeName(n) {
+	case "#comment", "head", "script", "style", "noscript", "iframe", "svg":
+	case "#text":
+		t.line.WriteString(whitespacePattern.ReplaceAllString(n.Text(), " "))
+	case "br":
+		t.line.WriteString("\n")
+	case "img":
+		if alt := strings.TrimSpace(n.AttrOr("alt", "")); alt != "" {
+			t.line.WriteString("[" + alt + "]")
+		}
+	case "pre":
+		t.flush()
+		var lines []string
+		for _, line := range strings.Split(strings.Trim(n.Text(), "\n"), "\n") {
+			line = strings.TrimRight(line, " \t\r")
+			if line != "" {
+				line = "    " + line
+			}
+			lines = append(lines, line)
+		}
+		t.blocks = append(t.blocks, strings.Join(lines, "\n"))
+	case "ul", "ol":
+		t.flush()
+		var lines []string
+		listItems(n, 0, &lines)
+		if len(lines) > 0 {
+			t.blocks = append(t.blocks, strings.Join(lines, "\n"))
+		}
+	case "table":
+		t.flush()
+		var rows []string
+		n.Find("tr").Each(func(i int, row *goquery.Selection) {
+			var cells []string
+			row.ChildrenFiltered("th, td").Each(func(j int, cell *goquery.Selection) {
+				cells = append(cells, strings.TrimSpace(whitespacePattern.ReplaceAllString(cell.Text(), " ")))
+			})
+			rows = append(rows, strings.Join(cells, " | "))
+		})
+		if len(rows) > 0 {
+			t.blocks = append(t.blocks, strings.Join(rows, "\n"))
+		}
+	case "p", "div", "section", "article", "main", "header", "footer", "aside", "nav", "figure", "figcaption",
+		"blockquote", "h1", "h2", "h3", "h4", "h5", "h6", "hr", "li", "dl", "dt", "dd", "details", "summary", "center", "address":
+		t.flush()
+		t.children(n)
+		t.flush()
+	default:
+		t.children(n)
+	}
+}
+
+// listItems appends a line per item of the list n, nested lists indented
+// by two spaces per level and their items' further paragraphs aligned
+// with the text after the marker.
+func listItems(n *goquery.Selection, depth int, lines *[]string) {
+	number := 1
+	ordered := n.Is("ol")
+	n.ChildrenFiltered("li").Each(func(i int, item *goquery.Selection) {
+		marker := "- "
+		if ordered {
+			marker = fmt.Sprintf("%d. ", number)
+			number++
+		}
+		indent := strings.Repeat("  ", depth)
+		var nested []*goquery.Selection
+		sub := &textBuilder{}
+		item.Contents().Each(func(j int, c *goquery.Selection) {
+			if c.Is("ul, ol") {
+				nested = append(nested, c)
+				return
+			}
+			sub.node(c)
+		})
+		sub.flush()
+		text := strings.Join(sub.blocks, "\n")
+		*lines = append(*lines, indent+marker+strings.ReplaceAll(text, "\n", "\n"+indent+strings.Repeat(" ", len(marker))))
+		for _, list := range nested {
+			listItems(list, depth+1, lines)
+		}
+	})
+}
+
+// textBook renders the book as plain text, titled like the html format:
+// the book title first and, in a series, the title of every part.
+func textBook(title string, rendered []renderedPart, appendix string, refs *references) (string, error) {
+	t := &textBuilder{}
+	t.blocks = append(t.blocks, strings.TrimSpace(title))
+	for _, r := range rendered {
+		if len(rendered) > 1 {
+			t.blocks = append(t.blocks, strings.TrimSpace(r.title))
+		}
+		if err := t.html(r.body + r.footer + r.comments); err != nil {
+			return "", err
+		}
+	}
+	if appendix != "" {
+		if err := t.html(appendix); err != nil {
+			return "", err
+		}
+	}
+	if len(refs.urls) > 0 {
+		if err := t.html(referencesHTML(refs)); err != nil {
+			return "", err
+		}
+	}
+	return strings.Join(t.blocks, "\n\n") + "\n", nil
+}
@@ -1,233 +1,759 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/PuerkitoBio/goquery"
-	"github.com/bmaupin/go-epub"
-	"github.com/go-shiori/go-readability"
+	"github.com/pamypas/habrdownloader/habrdl"
+	"golang.org/x/time/rate"
 )
 
-// sanitizeFileName creates a safe file name from the article title.
-// It replaces characters that are illegal on most file systems with an underscore
-// and collapses consecutive spaces/underscores.
-func sanitizeFileName(name string) string {
-	name = strings.TrimSpace(name)
-	// Characters not allowed in Windows filenames and also problematic on Unix.
-	illegal := regexp.MustCompile(`[<>:"/\\|?*\x00-\x1F]`)
-	name = illegal.ReplaceAllString(name, "_")
-	// Collapse multiple spaces or underscores into a single underscore.
-	collapse := regexp.MustCompile(`[\s_]+`)
-	name = collapse.ReplaceAllString(name, "_")
-	return name
-}
-
-// fetchURL downloads the content of the given URL and returns it as a byte slice.
-func fetchURL(url string) ([]byte, error) {
-	resp, err := http.Get(url)
+// readURLList reads article URLs from a file, one per line. Blank lines and
+// lines starting with '#' are ignored. Malformed lines are reported as
+// errors carrying the file name and line number and do not stop reading.
+func readURLList(path string) ([]string, []error, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("unexpected HTTP status: %d", resp.StatusCode)
+	defer f.Close()
+
+	var urls []string
+	var lineErrs []error
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		u, err := url.Parse(line)
+		if err == nil && ((u.Scheme != "http" && u.Scheme != "https") || u.Host == "") {
+			err = errors.New("not an absolute http(s) URL")
+		}
+		if err != nil {
+			lineErrs = append(lineErrs, fmt.Errorf("%s:%d: invalid URL %q: %v", path, lineNo, line, err))
+			continue
+		}
+		urls = append(urls, line)
 	}
-	return io.ReadAll(resp.Body)
+	return urls, lineErrs, scanner.Err()
 }
 
-// fetchBinary downloads binary content (e.g., images) and returns the data and a guessed file extension.
-func fetchBinary(resourceURL string) ([]byte, string, error) {
-	resp, err := http.Get(resourceURL)
-	if err != nil {
-		return nil, "", err
+// urlList collects the values of a repeatable string flag.
+type urlList []string
+
+func (l *urlList) String() string { return strings.Join(*l, ", ") }
+
+func (l *urlList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
+// logLevel selects how much the tool prints.
+type logLevel int
+
+const (
+	levelQuiet logLevel = iota
+	levelNormal
+	levelVerbose
+)
+
+// logger prints leveled messages. Errors are always shown, warnings and
+// results are hidden by -q, and details appear only with -v.
+type logger struct {
+	level logLevel
+	// tty is set when stderr is a terminal, so progress can be redrawn in place.
+	tty bool
+
+	mu sync.Mutex
+	// midLine is set while a progress line is shown without its newline.
+	midLine bool
+}
+
+// printf writes a message on a line of its own, ending any progress line first.
+func (l *logger) printf(w *os.File, format string, args ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.midLine {
+		fmt.Fprintln(os.Stderr)
+		l.midLine = false
 	}
-	defer resp.Body.Close()
+	fmt.Fprintf(w, format+"\n", args...)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, "", fmt.Errorf("unexpected HTTP status: %d", resp.StatusCode)
+// Errorf prints an error to stderr.
+func (l *logger) Errorf(format string, args ...interface{}) {
+	l.printf(os.Stderr, format, args...)
+}
+
+// Warnf prints a warning to stderr unless running quietly.
+func (l *logger) Warnf(format string, args ...interface{}) {
+	if l.level >= levelNormal {
+		l.printf(os.Stderr, format, args...)
 	}
+}
 
-	data, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, "", err
+// Infof prints a result to stdout unless running quietly.
+func (l *logger) Infof(format string, args ...interface{}) {
+	if l.level >= levelNormal {
+		l.printf(os.Stdout, format, args...)
 	}
+}
 
-	ct := resp.Header.Get("Content-Type")
-	ext := ""
-	switch {
-	case strings.Contains(ct, "jpeg"), strings.Contains(ct, "jpg"):
-		ext = ".jpg"
-	case strings.Contains(ct, "png"):
-		ext = ".png"
-	case strings.Contains(ct, "gif"):
-		ext = ".gif"
-	case strings.Contains(ct, "webp"):
-		ext = ".webp"
-	case strings.Contains(ct, "svg"):
-		ext = ".svg"
-	default:
-		ext = ""
+// Debugf prints a detail to stderr in verbose mode.
+func (l *logger) Debugf(format string, args ...interface{}) {
+	if l.level >= levelVerbose {
+		l.printf(os.Stderr, format, args...)
 	}
+}
 
-	return data, ext, nil
+// Progress shows how many images have been downloaded. On a terminal the
+// counter is redrawn in place; otherwise a line is printed every ten
+// images of articles with at least that many. -q hides it.
+func (l *logger) Progress(done, total int) {
+	if l.level < levelNormal {
+		return
+	}
+	if !l.tty {
+		if total >= 10 && (done%10 == 0 || done == total) {
+			l.printf(os.Stderr, "downloading images: %d/%d", done, total)
+		}
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fmt.Fprintf(os.Stderr, "\rdownloading images: %d/%d", done, total)
+	l.midLine = done < total
+	if !l.midLine {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+// log is shared by the whole run; -v and -q change its level.
+var log = &logger{level: levelNormal, tty: isTerminal(os.Stderr)}
+
+// outputFormats are the accepted -format values.
+var outputFormats = map[string]bool{
+	"epub": true, "html": true, "fb2": true, "md": true, "txt": true, "json": true,
+	"mobi": true, "azw3": true, "pdf": true,
+}
+
+// isTerminal reports whether f is a character device such as a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
 }
 
 func main() {
 	// Command‑line flags
-	articleURL := flag.String("url", "", "Full URL of the Habr article to download (required)")
-	outputDir := flag.String("out", ".", "Directory where the EPUB file will be saved")
+	var articleURLs urlList
+	flag.Var(&articleURLs, "url", "Full URL of a Habr article to download (repeatable; URLs may also follow the flags)")
+	listFile := flag.String("list", "", "File with article URLs to download, one per line")
+	user := flag.String("user", "", "Download every article of this Habr user (name or profile articles URL), following the listing's pages")
+	bookmarks := flag.String("bookmarks", "", "Download the bookmarks of this Habr user (name or listing URL); private bookmarks need -cookie or -cookie-file")
+	hub := flag.String("hub", "", "Download the articles of this Habr hub (slug or listing URL); see -min-rating, -since and -until")
+	feedURL := flag.String("feed", "", "Download the articles linked from this RSS or Atom feed (e.g. https://habr.com/ru/rss/articles/)")
+	company := flag.String("company", "", "Download every post of this company blog (slug or listing URL), following the listing's pages")
+	minRating := flag.Int("min-rating", 0, "With a listing (-user, -bookmarks, -hub, -company, -feed), only download articles rated at least this high")
+	since := flag.String("since", "", "With a listing (-user, -bookmarks, -hub, -company, -feed), only download articles published on or after this date (YYYY-MM-DD)")
+	sinceID := flag.Int("since-id", 0, "With a listing (-user, -bookmarks, -hub, -company, -feed), only download articles with a Habr ID greater than this one")
+	limit := flag.Int("limit", 0, "With a listing (-user, -bookmarks, -hub, -company, -feed), download at most this many of the articles that pass the other filters, in listing order (0 means no limit)")
+	until := flag.String("until", "", "With a listing (-user, -bookmarks, -hub, -company, -feed), only download articles published on or before this date (YYYY-MM-DD)")
+	pageFile := flag.String("file", "", "Convert a saved article page (.html or .html.gz) instead of downloading one; needs -base-url")
+	baseURL := flag.String("base-url", "", "URL the -file page was saved from, used for relative links and the attribution")
+	allowAnyHost := flag.Bool("allow-any-host", false, "Accept article URLs on hosts other than habr.com (e.g. mirrors)")
+	outputDir := flag.String("out", ".", "Directory or file path where the book will be saved, or - for standard output")
+	mkdir := flag.Bool("mkdir", false, "Create the -out directory if it does not exist")
+	format := flag.String("format", "epub", "Output format: epub, html (single file with inlined images), fb2 (FictionBook 2), md (Markdown with an assets folder), txt (plain text), json (parsed article data), mobi, azw3 or pdf (converted with ebook-convert or kindlegen); several separated by commas are built from one download")
+	kepub := flag.Bool("kepub", false, "Write the EPUB in Kobo's kepub flavor, as a .kepub.epub file")
+	epubVersion := flag.String("epub-version", "", "Set to 3 to write strict EPUB 3 sections with epub:type semantics and landmarks")
+	keepEPUB := flag.Bool("keep-epub", false, "With -format mobi, azw3 or pdf, also keep the intermediate EPUB")
+	timeout := flag.Duration("timeout", 30*time.Second, "Timeout for each HTTP request, including the body download")
+	agent := flag.String("user-agent", habrdl.DefaultUserAgent, "User-Agent header sent with every request")
+	retries := flag.Int("retries", 3, "How many times to retry a request after a network error or 5xx response")
+	rateLimit := flag.Float64("rate", 0, "Maximum requests per second across pages and images (0 means unlimited)")
+	proxy := flag.String("proxy", "", "Proxy for all requests: http://, https:// or socks5:// URL (default: HTTP_PROXY/HTTPS_PROXY)")
+	cookie := flag.String("cookie", "", "Cookie header sent to Habr (e.g. a logged-in browser session); never sent to other hosts")
+	cookieFile := flag.String("cookie-file", "", "cookies.txt file in Netscape format to read the Habr session cookie from")
+	lang := flag.String("lang", "", "Book language (e.g. ru or en); detected from the page by default")
+	highlightStyle := flag.String("highlight-style", "none", "Color scheme of code blocks: none, or a chroma style such as github (light) or monokai (dark)")
+	cssFile := flag.String("css", "", "Stylesheet to use instead of the bundled one")
+	pruneCSS := flag.Bool("prune-css", false, "Drop the stylesheet rules whose classes and IDs nothing in the book uses")
+	fontFile := flag.String("font", "", "TrueType/OpenType font to embed and use for the article text, or builtin for the bundled Go Regular, which covers Cyrillic")
+	concurrency := flag.Int("concurrency", 4, "Number of images downloaded in parallel")
+	webpMode := flag.String("webp", "auto", "What to do with still WebP images: auto (PNG, or JPEG for photos), png, jpg or keep; AVIF images cannot be converted and are dropped with a warning")
+	spoilers := flag.String("spoilers", "expand", "How Habr spoilers are shown: expand (always open, titled boxes) or details (foldable <details>, for EPUB 3 readers)")
+	minImageSize := flag.Int("min-image-size", 0, "Drop images narrower or lower than this many pixels, such as tracking pixels and icons (e.g. 8; 0 keeps them all)")
+	minImageBytes := flag.Int("min-image-bytes", 0, "Drop images smaller than this many bytes (0 keeps them all)")
+	gifMode := flag.String("gif", "keep", "What to do with animated GIFs: keep, or first-frame to embed the first frame as PNG for e-ink readers")
+	svgImageWidth := flag.Int("svg-image-width", 0, "Rasterize downloaded SVG images to PNGs this many pixels wide, for readers without SVG support (0 keeps them as SVG)")
+	svgMode := flag.String("svg", "raster", "What to do with inline SVG drawings: raster (embed as PNG) or inline")
+	grayscale := flag.Bool("grayscale", false, "Convert JPEG, PNG and still GIF images to 8-bit grayscale, for e-ink readers")
+	jpegQuality := flag.Int("jpeg-quality", 0, "Re-encode JPEG images at this quality, 1-100, when that makes them smaller (0 re-encodes only downscaled ones)")
+	maxImageWidth := flag.Int("max-image-width", 0, "Downscale JPEG and PNG images wider than this many pixels (0 keeps the original size)")
+	noImages := flag.Bool("no-images", false, "Skip all images, keeping only their alt text")
+	strictImages := flag.Bool("strict-images", false, "Fail if any article image cannot be embedded")
+	math := flag.String("math", "tex", "How to keep KaTeX formulas: tex (TeX source as code) or mathml")
+	strip := flag.String("strip", "", "Extra CSS selectors (comma-separated) of page blocks to remove, on top of Habr's share/vote widgets and banners")
+	minContentLength := flag.Int("min-content-length", 500, "Characters readability expects of an article before it relaxes its cleanup and retries")
+	keepFigures := flag.Bool("keep-figures", false, "Unwrap the containers around figures so readability does not drop images with short captions")
+	depth := flag.Int("depth", 0, "Also add the Habr articles linked from the text, this many levels deep, as further chapters with links pointing inside the book")
+	preferAPI := flag.Bool("api", false, "Take articles from Habr's JSON API and scrape the page only when the API fails")
+	noFallback := flag.Bool("no-fallback", false, "Do not retry through Habr's article API when the page yields almost no text")
+	footnotes := flag.Bool("footnotes", false, "Replace external links in the text with numbered footnotes and list their URLs in a References section")
+	randomID := flag.Bool("uuid", false, "Give the EPUB a random UUID instead of the stable urn:habr:<id> identifier")
+	noCover := flag.Bool("no-cover", false, "Do not add a cover image; same as -cover none, and an error with any other -cover")
+	cover := flag.String("cover", "lead", "Cover of the book: lead (the article's lead image, else one drawn from the title), generate (always drawn) or none")
+	splitHeadings := flag.Bool("split-headings", false, "Split the article into one EPUB section per <h2> and <h3> heading, nested in the table of contents")
+	readingTime := flag.Bool("reading-time", true, "Show the word count and estimated reading time under the title (-reading-time=false to disable)")
+	embedCode := flag.Bool("embed-code", true, "Fetch the source of embedded gists and CodePen demos into the book (-embed-code=false to keep links only)")
+	frontPage := flag.Bool("front-page", true, "Start the EPUB with a page listing the source, author, date, hubs, tags, rating and reading time (-front-page=false to disable)")
+	noAttribution := flag.Bool("no-attribution", false, "Do not append the source/author/date footer to the article")
+	comments := flag.Bool("comments", false, "Append the article comments as a separate section")
+	commentsMinRating := flag.Int("comments-min-rating", 0, "With -comments, leave out comments rated below this (replies that are kept keep their parents)")
+	series := flag.Bool("series", false, "Collect every part of the article's series into one book, one section per part")
+	anthology := flag.Bool("anthology", false, "Compile all given articles (URLs, -list and listings) into one book, one section per article; see -title")
+	bookTitle := flag.String("title", "", "Title of the book instead of the first article's, e.g. for -anthology")
+	seriesLinks := flag.Bool("series-links", false, "Append links to the other parts of the article series")
+	nameTemplate := flag.String("name-template", "{title}", "Output file name; placeholders: {title}, {author}, {date}, {id}")
+	spaceReplacement := flag.String("space-replacement", "_", `What replaces spaces in file names: "_", "-" or " " to keep them`)
+	cacheDir := flag.String("cache-dir", "", "Directory of the image cache used by batch and -series runs (default: the user cache folder); setting it also enables the cache for single articles")
+	noCache := flag.Bool("no-cache", false, "Do not use the image cache")
+	skipExisting := flag.Bool("skip-existing", false, "Skip articles whose output file already exists (images are not downloaded)")
+	dryRun := flag.Bool("dry-run", false, "Print the extracted metadata without downloading images or writing files")
+	verbose := flag.Bool("v", false, "Verbose output: log every download, including skipped images and the reason")
+	quiet := flag.Bool("q", false, "Quiet output: print errors only")
 	flag.Parse()
+	articleURLs = append(articleURLs, flag.Args()...)
 
-	if *articleURL == "" {
-		fmt.Fprintln(os.Stderr, "error: -url flag is required")
-		flag.Usage()
+	switch {
+	case *verbose && *quiet:
+		log.Errorf("error: -v and -q cannot be used together")
 		os.Exit(1)
+	case *verbose:
+		log.level = levelVerbose
+	case *quiet:
+		log.level = levelQuiet
 	}
 
-	// 1. Download the page
-	rawHTML, err := fetchURL(*articleURL)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to fetch URL: %v\n", err)
+	// Lines of -list that could not be parsed count as failed articles.
+	var listErrs []error
+	if *listFile != "" {
+		urls, lineErrs, err := readURLList(*listFile)
+		if err != nil {
+			log.Errorf("failed to read URL list: %v", err)
+			os.Exit(1)
+		}
+		articleURLs = append(articleURLs, urls...)
+		listErrs = lineErrs
+	}
+
+	// Article listings to crawl, and which of their articles to keep.
+	var listings []listing
+	if *user != "" {
+		listings = append(listings, listing{url: habrdl.UserArticlesURL(*user)})
+	}
+	if *bookmarks != "" {
+		listings = append(listings, listing{url: habrdl.BookmarksURL(*bookmarks), bookmarks: true})
+	}
+	if *hub != "" {
+		listings = append(listings, listing{url: habrdl.HubArticlesURL(*hub)})
+	}
+	if *company != "" {
+		listings = append(listings, listing{url: habrdl.CompanyArticlesURL(*company)})
+	}
+	if *feedURL != "" {
+		listings = append(listings, listing{url: *feedURL, feed: true})
+	}
+	filter := listingFilter{sinceID: *sinceID, limit: *limit}
+	var commentsFilter *int
+	coverSet := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "min-rating":
+			filter.minRating = minRating
+		case "comments-min-rating":
+			commentsFilter = commentsMinRating
+		case "cover":
+			coverSet = true
+		}
+	})
+	for _, d := range []struct {
+		name  string
+		value string
+		dst   *time.Time
+	}{{"since", *since, &filter.since}, {"until", *until, &filter.until}} {
+		if d.value == "" {
+			continue
+		}
+		t, err := time.Parse("2006-01-02", d.value)
+		if err != nil {
+			log.Errorf("error: invalid -%s value %q (want YYYY-MM-DD)", d.name, d.value)
+			os.Exit(1)
+		}
+		*d.dst = t
+	}
+	if *sinceID < 0 {
+		log.Errorf("error: invalid -since-id value %d (want an article ID)", *sinceID)
+		os.Exit(1)
+	}
+	if *limit < 0 {
+		log.Errorf("error: invalid -limit value %d (want 0 or more)", *limit)
+		os.Exit(1)
+	}
+	if (filter.minRating != nil || !filter.since.IsZero() || !filter.until.IsZero() || filter.sinceID != 0 || filter.limit != 0) && len(listings) == 0 {
+		log.Errorf("error: -min-rating, -since, -since-id, -until and -limit need a listing (-user, -bookmarks, -hub, -company or -feed)")
 		os.Exit(1)
 	}
 
-	// 2. Parse the base URL for readability
-	parsedURL, err := url.Parse(*articleURL)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "invalid URL provided: %v\n", err)
+	// A saved page stands in for the download of its base URL.
+	if *pageFile != "" {
+		if len(articleURLs) > 0 || *listFile != "" || len(listings) > 0 {
+			log.Errorf("error: -file cannot be combined with -url, -list or a listing (-user, -bookmarks, -hub, -company, -feed)")
+			os.Exit(1)
+		}
+		if *baseURL == "" {
+			log.Errorf("error: -file needs -base-url, the address the page was saved from")
+			os.Exit(1)
+		}
+		articleURLs = urlList{*baseURL}
+	} else if *baseURL != "" {
+		log.Errorf("error: -base-url is only used with -file")
 		os.Exit(1)
 	}
 
-	// 3. Extract the main article using go‑readability
-	article, err := readability.FromReader(strings.NewReader(string(rawHTML)), parsedURL)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to parse article: %v\n", err)
+	if len(articleURLs) == 0 && len(listErrs) == 0 && len(listings) == 0 {
+		log.Errorf("error: -url flag is required")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *anthology && *series {
+		log.Errorf("error: -anthology and -series cannot be used together")
+		os.Exit(1)
+	}
+	if *outputDir == "-" && !*anthology && (len(articleURLs)+len(listErrs) > 1 || *listFile != "" || len(listings) > 0) {
+		log.Errorf("error: -out - writes a single book and cannot be used with several URLs")
+		os.Exit(1)
+	}
+	formats := strings.Split(*format, ",")
+	for i, f := range formats {
+		formats[i] = strings.TrimSpace(f)
+		if !outputFormats[formats[i]] {
+			log.Errorf("error: invalid -format value %q (want epub, html, fb2, md, txt, json, mobi, azw3 or pdf, or several separated by commas)", formats[i])
+			os.Exit(1)
+		}
+		if formats[i] == "md" && *outputDir == "-" && !*noImages {
+			log.Errorf("error: -format md saves images into an assets folder and cannot be used with -out - (add -no-images)")
+			os.Exit(1)
+		}
+		if err := habrdl.CheckConverter(formats[i]); err != nil && !*dryRun {
+			log.Errorf("error: %v", err)
+			os.Exit(1)
+		}
+	}
+	if len(formats) > 1 {
+		if *outputDir == "-" {
+			log.Errorf("error: -out - writes a single book and cannot be used with several formats")
+			os.Exit(1)
+		}
+		if info, err := os.Stat(*outputDir); (err != nil || !info.IsDir()) && outputFormats[strings.TrimPrefix(strings.ToLower(filepath.Ext(*outputDir)), ".")] {
+			log.Errorf("error: with several formats -out must be a directory")
+			os.Exit(1)
+		}
+	}
+	// Check the destination before anything is downloaded.
+	if *outputDir != "-" && !*dryRun {
+		if err := habrdl.PrepareOutputDir(*outputDir, habrdl.OutputExt(formats[0], *kepub), *mkdir); err != nil {
+			log.Errorf("error: %v", err)
+			os.Exit(1)
+		}
+	}
+	if *webpMode != "auto" && *webpMode != "keep" && *webpMode != "png" && *webpMode != "jpg" {
+		log.Errorf("error: invalid -webp value %q (want auto, png, jpg or keep)", *webpMode)
+		os.Exit(1)
+	}
+	if *jpegQuality < 0 || *jpegQuality > 100 {
+		log.Errorf("error: invalid -jpeg-quality value %d (want 1-100, or 0 to keep JPEG images as they are)", *jpegQuality)
+		os.Exit(1)
+	}
+	if *maxImageWidth < 0 {
+		log.Errorf("error: invalid -max-image-width value %d (want a width in pixels, or 0 to keep the original size)", *maxImageWidth)
+		os.Exit(1)
+	}
+
+	if *highlightStyle != "none" && !habrdl.HighlightStyleExists(*highlightStyle) {
+		log.Errorf("error: invalid -highlight-style value %q (want none or a chroma style such as github or monokai)", *highlightStyle)
+		os.Exit(1)
+	}
+	if *highlightStyle == "none" {
+		*highlightStyle = ""
+	}
+	if *cover != "lead" && *cover != "generate" && *cover != "none" {
+		log.Errorf("error: invalid -cover value %q (want lead, generate or none)", *cover)
+		os.Exit(1)
+	}
+	// -no-cover is kept as a shorthand for -cover none.
+	if *noCover {
+		if coverSet && *cover != "none" {
+			log.Errorf("error: -no-cover cannot be combined with -cover %s", *cover)
+			os.Exit(1)
+		}
+		*cover = "none"
+	}
+	if *epubVersion != "" && *epubVersion != "3" {
+		log.Errorf("error: invalid -epub-version value %q (want 3)", *epubVersion)
 		os.Exit(1)
 	}
 
-	// 4. Prepare EPUB
-	title := article.Title
-	if strings.TrimSpace(title) == "" {
-		title = "Habr Article"
+	if *spoilers != "expand" && *spoilers != "details" {
+		log.Errorf("error: invalid -spoilers value %q (want expand or details)", *spoilers)
+		os.Exit(1)
+	}
+	if *minImageSize < 0 || *minImageBytes < 0 {
+		log.Errorf("error: -min-image-size and -min-image-bytes cannot be negative")
+		os.Exit(1)
+	}
+	if *gifMode != "keep" && *gifMode != "first-frame" {
+		log.Errorf("error: invalid -gif value %q (want keep or first-frame)", *gifMode)
+		os.Exit(1)
+	}
+	if *svgImageWidth < 0 {
+		log.Errorf("error: invalid -svg-image-width value %d (want a width in pixels, or 0 to keep SVG images)", *svgImageWidth)
+		os.Exit(1)
+	}
+	if *svgMode != "raster" && *svgMode != "inline" {
+		log.Errorf("error: invalid -svg value %q (want raster or inline)", *svgMode)
+		os.Exit(1)
+	}
+	if *depth < 0 {
+		log.Errorf("error: -depth must not be negative")
+		os.Exit(1)
+	}
+	if *minContentLength < 1 {
+		log.Errorf("error: -min-content-length must be positive")
+		os.Exit(1)
+	}
+	if *math != "tex" && *math != "mathml" {
+		log.Errorf("error: invalid -math value %q (want tex or mathml)", *math)
+		os.Exit(1)
 	}
-	e := epub.NewEpub(title)
-	// Author is not always available from readability; set a generic one.
-	e.SetAuthor("Habr")
 
-	// 5. Parse article HTML and embed images
-	doc, err := goquery.NewDocumentFromReader(strings.NewReader(article.Content))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to parse article HTML: %v\n", err)
+	if *spaceReplacement != "_" && *spaceReplacement != "-" && *spaceReplacement != " " {
+		log.Errorf("error: invalid -space-replacement value %q (want _, - or a space)", *spaceReplacement)
 		os.Exit(1)
 	}
 
-	imgCounter := 1
+	var stripSelectors []string
+	if *strip != "" {
+		stripSelectors = []string{*strip}
+	}
 
-	doc.Find("img").Each(func(i int, s *goquery.Selection) {
-		src, exists := s.Attr("src")
-		if !exists {
-			return
-		}
-		src = strings.TrimSpace(src)
-		if src == "" {
-			return
+	var client *http.Client
+	if *proxy != "" {
+		var err error
+		if client, err = habrdl.ProxyClient(*proxy); err != nil {
+			log.Errorf("error: invalid -proxy value: %v", err)
+			os.Exit(1)
 		}
+	}
 
-		// Resolve relative URLs against the article URL
-		imgURL, err := parsedURL.Parse(src)
+	fetcher := habrdl.NewFetcher(client)
+	fetcher.Timeout = *timeout
+	fetcher.UserAgent = *agent
+	fetcher.Retries = *retries
+	fetcher.Logf = log.Warnf
+	fetcher.Cookie = *cookie
+	if *rateLimit > 0 {
+		fetcher.Limiter = rate.NewLimiter(rate.Limit(*rateLimit), 1)
+	}
+	if *cookieFile != "" {
+		fileCookie, err := habrdl.ReadCookieFile(*cookieFile)
 		if err != nil {
-			return
+			log.Errorf("failed to read cookie file: %v", err)
+			os.Exit(1)
 		}
+		switch {
+		case fetcher.Cookie == "":
+			fetcher.Cookie = fileCookie
+		case fileCookie != "":
+			fetcher.Cookie += "; " + fileCookie
+		}
+	}
 
-		data, ext, err := fetchBinary(imgURL.String())
+	// Listings are expanded into their articles once the fetcher is set up.
+	if *bookmarks != "" && fetcher.Cookie == "" {
+		log.Warnf("warning: no -cookie or -cookie-file given; only public bookmarks can be listed")
+	}
+	for _, l := range listings {
+		urls, err := crawlListing(fetcher, l, filter)
 		if err != nil {
-			return
+			log.Errorf("failed to list articles at %s: %v%s", l.url, err, errorHint(err))
+			os.Exit(1)
 		}
+		articleURLs = append(articleURLs, urls...)
+	}
+	if len(listings) > 0 && len(articleURLs) == 0 && len(listErrs) == 0 {
+		log.Infof("no articles to download")
+		return
+	}
 
-		if ext == "" {
-			// Try to guess extension from URL path as a fallback
-			ext = filepath.Ext(imgURL.Path)
+	// Batches and series share banners and avatars, so their images are
+	// cached on disk.
+	if !*noCache && (*cacheDir != "" || *series || *listFile != "" || len(articleURLs) > 1) {
+		dir := *cacheDir
+		if dir == "" {
+			var err error
+			if dir, err = habrdl.DefaultCacheDir(); err != nil {
+				log.Warnf("warning: image cache disabled: %v", err)
+			}
 		}
-		if ext == "" {
-			ext = ".img"
+		fetcher.CacheDir = dir
+		log.Debugf("caching images in %s", dir)
+	}
+
+	// An anthology is a single book: the first article leads it and the
+	// others follow as its further parts.
+	var anthologyURLs []string
+	if *anthology && len(articleURLs) > 0 {
+		for _, err := range listErrs {
+			log.Errorf("%v", err)
 		}
+		listErrs = nil
+		anthologyURLs = append(anthologyURLs, articleURLs[1:]...)
+		articleURLs = articleURLs[:1]
+	}
 
-		imgFileName := fmt.Sprintf("image_%03d%s", imgCounter, ext)
-		imgCounter++
+	opts := habrdl.Options{
+		Fetcher:           fetcher,
+		PageFile:          *pageFile,
+		Format:            formats[0],
+		Kepub:             *kepub,
+		EPUB3:             *epubVersion == "3",
+		KeepEPUB:          *keepEPUB,
+		Concurrency:       *concurrency,
+		WebPMode:          *webpMode,
+		MaxImageWidth:     *maxImageWidth,
+		JPEGQuality:       *jpegQuality,
+		Grayscale:         *grayscale,
+		StrictImages:      *strictImages,
+		NoImages:          *noImages,
+		AllowAnyHost:      *allowAnyHost,
+		CSSFile:           *cssFile,
+		PruneCSS:          *pruneCSS,
+		HighlightStyle:    *highlightStyle,
+		SplitHeadings:     *splitHeadings,
+		Comments:          *comments,
+		CommentsMinRating: commentsFilter,
+		Lang:              *lang,
+		NoAttribution:     *noAttribution,
+		NoFrontPage:       !*frontPage,
+		NoEmbedCode:       !*embedCode,
+		SeriesLinks:       *seriesLinks,
+		Logf:              log.Warnf,
+		Debugf:            log.Debugf,
+		Progress:          log.Progress,
+		Math:              *math,
+		SVGMode:           *svgMode,
+		SVGImageWidth:     *svgImageWidth,
+		GIFMode:           *gifMode,
+		MinImageSize:      *minImageSize,
+		MinImageBytes:     *minImageBytes,
+		Spoilers:          *spoilers,
+		Series:            *series,
+		Anthology:         anthologyURLs,
+		Title:             *bookTitle,
+		Strip:             stripSelectors,
+		FontFile:          *fontFile,
+		NoReadingTime:     !*readingTime,
+		NoFallback:        *noFallback,
+		Depth:             *depth,
+		PreferAPI:         *preferAPI,
+		MinContentLength:  *minContentLength,
+		KeepFigures:       *keepFigures,
+		Footnotes:         *footnotes,
+		RandomIdentifier:  *randomID,
+		NoCover:           *cover == "none",
+		GenerateCover:     *cover == "generate",
+		NameTemplate:      *nameTemplate,
+		SkipExisting:      *skipExisting,
+		SpaceReplacement:  *spaceReplacement,
+	}
 
-		// Write image to a stable temp directory that will live until process exit.
-		// We do NOT defer os.Remove here, because go-epub reads the file later
-		// when e.Write() is called.
-		tmpDir := os.TempDir()
-		tmpPath := filepath.Join(tmpDir, imgFileName)
+	download := func(articleURL, out string, opts habrdl.Options) error {
+		return downloadArticle(articleURL, out, formats, opts)
+	}
+	if *dryRun {
+		download = inspectArticle
+	}
 
-		if err := os.WriteFile(tmpPath, data, 0o600); err != nil {
-			return
+	if len(articleURLs) == 1 && (*listFile == "" || *anthology) {
+		if err := download(articleURLs[0], *outputDir, opts); err != nil {
+			log.Errorf("%v%s", err, errorHint(err))
+			os.Exit(1)
 		}
+		return
+	}
 
-		// go-epub AddImage expects a filesystem path.
-		imgPath, err := e.AddImage(tmpPath, imgFileName)
-		if err != nil {
-			return
+	// Batch mode: a failing article does not stop the rest of the run.
+	for _, err := range listErrs {
+		log.Errorf("%v", err)
+	}
+	failed := len(listErrs)
+	total := len(articleURLs) + len(listErrs)
+	var failedURLs []string
+	for _, articleURL := range articleURLs {
+		if err := download(articleURL, *outputDir, opts); err != nil {
+			log.Errorf("%s: %v%s", articleURL, err, errorHint(err))
+			failedURLs = append(failedURLs, articleURL)
+			failed++
 		}
+	}
+	verb := "downloaded"
+	if *dryRun {
+		verb = "checked"
+	}
+	log.Infof("%s %d/%d articles (%d failed)", verb, total-failed, total, failed)
+	// Repeat the failures at the end, where a long run's errors have
+	// scrolled away, ready to be fed back through -list.
+	for _, articleURL := range failedURLs {
+		log.Infof("failed: %s", articleURL)
+	}
+	if failed == total {
+		os.Exit(1)
+	}
+}
 
-		// Update the img src to point to the EPUB image path
-		s.SetAttr("src", imgPath)
-	})
+// errorHint returns the flags that may help with err, or "".
+func errorHint(err error) string {
+	switch {
+	case errors.Is(err, habrdl.ErrMembersOnly), errors.Is(err, habrdl.ErrAccessDenied):
+		return " (try -cookie or -cookie-file with a logged-in session)"
+	case errors.Is(err, habrdl.ErrRateLimited):
+		return " (try a lower -rate)"
+	}
+	return ""
+}
 
-	// 6. Serialize modified HTML
-	var bodyHTML string
-	if bodySel := doc.Find("body"); bodySel.Length() > 0 {
-		html, err := bodySel.Html()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to serialize body HTML: %v\n", err)
-			os.Exit(1)
-		}
-		bodyHTML = html
-	} else {
-		// Fallback: full document HTML
-		html, err := doc.Html()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "failed to serialize HTML: %v\n", err)
-			os.Exit(1)
-		}
-		bodyHTML = html
+// listingFilter selects the articles of a listing to download.
+type listingFilter struct {
+	// minRating, if set, is the lowest accepted rating.
+	minRating *int
+	// since and until bound the publication date, inclusive; zero means open.
+	since, until time.Time
+	// sinceID, if not zero, is the newest article ID already downloaded.
+	sinceID int
+	// limit, if not zero, caps the articles kept from one listing.
+	limit int
+}
+
+// keep reports whether a listed article passes the filter. Articles
+// without a date or an ID in the listing pass the bounds on them.
+func (f listingFilter) keep(a habrdl.ListedArticle) bool {
+	if f.minRating != nil && a.Rating < *f.minRating {
+		return false
+	}
+	if f.sinceID != 0 && a.ID != 0 && a.ID <= f.sinceID {
+		return false
 	}
+	if a.Published.IsZero() {
+		return true
+	}
+	if !f.since.IsZero() && a.Published.Before(f.since) {
+		return false
+	}
+	return f.until.IsZero() || a.Published.Before(f.until.AddDate(0, 0, 1))
+}
 
-	// Wrap bodyHTML into a minimal HTML document for EPUB section
-	var buf bytes.Buffer
-	buf.WriteString("<html><head><meta charset=\"utf-8\"></head><body>")
-	buf.WriteString(bodyHTML)
-	buf.WriteString("</body></html>")
+// listing is a source of article URLs: a paginated article list or a feed.
+type listing struct {
+	url  string
+	feed bool
+	// bookmarks lists articles by bookmark time rather than publication,
+	// so an old article may come first and the walk cannot stop early.
+	bookmarks bool
+}
 
-	// 7. Add content as a chapter
-	chapterTitle := title
-	if strings.TrimSpace(chapterTitle) == "" {
-		chapterTitle = "Article"
+// crawlListing returns the URLs of the articles of l that pass filter.
+func crawlListing(fetcher *habrdl.Fetcher, l listing, filter listingFilter) ([]string, error) {
+	log.Debugf("crawling %s", l.url)
+	var articles []habrdl.ListedArticle
+	var err error
+	if l.feed {
+		articles, err = habrdl.ListFeed(context.Background(), fetcher, l.url)
+	} else if l.bookmarks {
+		articles, err = habrdl.ListArticles(context.Background(), fetcher, l.url, time.Time{}, 0)
+	} else {
+		articles, err = habrdl.ListArticles(context.Background(), fetcher, l.url, filter.since, filter.sinceID)
 	}
-	_, err = e.AddSection(buf.String(), chapterTitle, "", "")
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "failed to add section to EPUB: %v\n", err)
-		os.Exit(1)
+		return nil, err
+	}
+	if len(articles) == 0 {
+		return nil, errors.New("no articles found")
+	}
+	var urls []string
+	for _, a := range articles {
+		if filter.limit != 0 && len(urls) == filter.limit {
+			break
+		}
+		if filter.keep(a) {
+			urls = append(urls, a.URL)
+		}
 	}
+	log.Infof("found %d articles at %s, %d to download", len(articles), l.url, len(urls))
+	return urls, nil
+}
 
-	// 8. Save EPUB
-	fileName := sanitizeFileName(title) + ".epub"
-	fullPath := filepath.Join(*outputDir, fileName)
+// downloadArticle converts a single article into each of formats and
+// saves the books under out, or streams the only one to stdout when out
+// is "-".
+func downloadArticle(articleURL, out string, formats []string, opts habrdl.Options) error {
+	if out == "-" {
+		book, err := habrdl.Convert(context.Background(), articleURL, opts)
+		if err != nil {
+			return err
+		}
+		defer book.Close()
+		if _, err := book.WriteTo(os.Stdout); err != nil {
+			return fmt.Errorf("failed to write %s: %w", strings.ToUpper(opts.Format), err)
+		}
+		return nil
+	}
 
-	if err := e.Write(fullPath); err != nil {
-		fmt.Fprintf(os.Stderr, "failed to write EPUB: %v\n", err)
-		os.Exit(1)
+	paths, err := habrdl.ConvertToFiles(context.Background(), articleURL, out, formats, opts)
+	if errors.Is(err, habrdl.ErrExists) {
+		log.Infof("skipping %s (exists)", strings.Join(paths, ", "))
+		return nil
 	}
+	for _, path := range paths {
+		log.Infof("%s saved to %s", strings.ToUpper(strings.TrimPrefix(filepath.Ext(path), ".")), path)
+	}
+	return err
+}
 
-	fmt.Printf("EPUB saved to %s\n", fullPath)
+// inspectArticle prints the metadata of a single article for -dry-run.
+// out is ignored; nothing is written.
+func inspectArticle(articleURL, out string, opts habrdl.Options) error {
+	book, err := habrdl.Inspect(context.Background(), articleURL, opts)
+	if err != nil {
+		return err
+	}
+	defer book.Close()
+	published := book.Published
+	if published == "" {
+		published = "unknown"
+	}
+	log.Infof("%s\n  title:     %s\n  author:    %s\n  published: %s\n  parts:     %d\n  images:    %d\n  words:     %d\n  reading:   ~%d min",
+		articleURL, book.Title, book.Author, published, book.Parts, book.Images, book.Words, book.ReadingTime)
+	return nil
 }